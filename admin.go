@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"bitbucket.org/kardianos/photosite/session"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Serializes edits so two admins do not overwrite each other.
+var userEdit sync.Mutex
+
+// editUsers applies fn to the user list read from the users file, saves it
+// and makes it current without waiting for the users file watcher. A file
+// with malformed lines is not edited until they are fixed by hand.
+func editUsers(fn func(userList *UserList) error) error {
+	userEdit.Lock()
+	defer userEdit.Unlock()
+
+	filename := filepath.Join(root, usersFileName)
+	userList, err := readUsers(filename)
+	if err != nil {
+		return err
+	}
+	err = fn(userList)
+	if err != nil {
+		return err
+	}
+	_, err = userList.hashPasswords()
+	if err != nil {
+		return err
+	}
+	err = saveUsers(filename, userList)
+	if err != nil {
+		return err
+	}
+	auth.Lock()
+	auth.AuthorizedList = userList
+	auth.Unlock()
+	return nil
+}
+
+func checkAdmin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+		c := w.(*Context)
+		if !c.Admin {
+			notFoundAuth(w, r)
+			return
+		}
+		if r.Method == "POST" && !sameOrigin(r) {
+			http.Error(w, "Bad request origin", 403)
+			return
+		}
+		h(w, r, vars)
+	}
+}
+
+type adminUser struct {
+	Username string
+	Groups   string
+	Disabled bool
+	Sessions int
+}
+
+type sortSessionInfo []session.Info
+
+func (s sortSessionInfo) Len() int           { return len(s) }
+func (s sortSessionInfo) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sortSessionInfo) Less(i, j int) bool { return s[i].Update.After(s[j].Update) }
+
+// /admin/
+func adminHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	c := w.(*Context)
+	list, err := sessions.List()
+	if err != nil {
+		log.Error("Error listing sessions: %v", err)
+		http.Error(w, "Failed to list sessions", 500)
+		return
+	}
+	sort.Sort(sortSessionInfo(list))
+	count := make(map[string]int, len(list))
+	for _, item := range list {
+		count[item.Username]++
+	}
+
+	var users []adminUser
+	auth.RLock()
+	if auth.AuthorizedList != nil {
+		users = make([]adminUser, len(auth.AuthorizedList.Order))
+		for i, u := range auth.AuthorizedList.Order {
+			users[i] = adminUser{
+				Username: u.Username,
+				Groups:   formatGroups(u.Groups, u.Roles),
+				Disabled: u.Disabled,
+				Sessions: count[u.Username],
+			}
+		}
+	}
+	auth.RUnlock()
+
+	err = allTemplates.ExecuteTemplate(w, "admin.template", struct {
+		Rand     int64
+		SiteName string
+		C        *Context
+		Users    []adminUser
+		Sessions []session.Info
+	}{
+		Rand:     rand.Int63(),
+		SiteName: siteName,
+		C:        c,
+		Users:    users,
+		Sessions: list,
+	})
+	if err != nil {
+		log.Error("Error running template: %v", err)
+		return
+	}
+}
+
+// adminEdit wraps a form post that changes the user list. Sessions of
+// disabled users are removed only once the new list has been saved.
+func adminEdit(fn func(c *Context, r *http.Request, userList *UserList) error) httprouter.Handle {
+	return checkAdmin(func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		c := w.(*Context)
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		var disabled []string
+		err = editUsers(func(userList *UserList) error {
+			err := fn(c, r, userList)
+			if err != nil {
+				return err
+			}
+			for _, u := range userList.Order {
+				if u.Disabled {
+					disabled = append(disabled, u.Username)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Error("Admin %s failed to edit users: %v", c.Username, err)
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		for _, username := range disabled {
+			err = sessions.Delete(username)
+			if err != nil {
+				log.Error("Failed to delete sessions for %s: %v", username, err)
+				http.Error(w, "Failed to logout disabled user", 500)
+				return
+			}
+		}
+		http.Redirect(w, r, "/admin/", 303)
+	})
+}
+
+func adminAddUser(c *Context, r *http.Request, userList *UserList) error {
+	username := r.Form.Get("username")
+	password := r.Form.Get("password")
+	if _, found := userList.ByUsername[username]; found {
+		return errors.New("User already exists")
+	}
+	err := validUsername(username)
+	if err != nil {
+		return err
+	}
+	err = validPassword(password)
+	if err != nil {
+		return err
+	}
+	groups, roles, err := parseGroups(r.Form.Get("groups"))
+	if err != nil {
+		return err
+	}
+	err = checkDownloadRoles(roles)
+	if err != nil {
+		return err
+	}
+	u := &User{
+		Username: username,
+		Password: password,
+		Groups:   groups,
+		Roles:    roles,
+	}
+	userList.Order = append(userList.Order, u)
+	userList.ByUsername[username] = u
+	log.Info("Admin %s added user %s.", c.Username, username)
+	return nil
+}
+
+func adminSetGroups(c *Context, r *http.Request, userList *UserList) error {
+	u, err := findUser(userList, r.Form.Get("username"))
+	if err != nil {
+		return err
+	}
+	groups, roles, err := parseGroups(r.Form.Get("groups"))
+	if err != nil {
+		return err
+	}
+	err = checkDownloadRoles(roles)
+	if err != nil {
+		return err
+	}
+	if u.Username == c.Username && !(&User{Groups: groups}).InGroup(adminGroup) {
+		return errors.New("Can not remove yourself from the admin group")
+	}
+	u.Groups = groups
+	u.Roles = roles
+	log.Info("Admin %s set groups of %s to %s.", c.Username, u.Username, formatGroups(groups, roles))
+	return nil
+}
+
+// checkDownloadRoles refuses a download role that would be ignored.
+func checkDownloadRoles(roles map[string][]string) error {
+	if groups := hiddenGPSDownloads(roles); len(groups) != 0 {
+		return fmt.Errorf("The %s role has no effect in hideGPS groups %s, only editors download their originals", roleDownloader, strings.Join(groups, ", "))
+	}
+	return nil
+}
+
+func adminSetDisabled(c *Context, r *http.Request, userList *UserList) error {
+	u, err := findUser(userList, r.Form.Get("username"))
+	if err != nil {
+		return err
+	}
+	if u.Username == c.Username {
+		return errors.New("Can not disable yourself")
+	}
+	u.Disabled = r.Form.Get("disabled") == "true"
+	if u.Disabled {
+		log.Info("Admin %s disabled user %s.", c.Username, u.Username)
+		return nil
+	}
+	log.Info("Admin %s enabled user %s.", c.Username, u.Username)
+	return nil
+}
+
+// /admin/api/logout
+func adminLogout(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	c := w.(*Context)
+	username := r.FormValue("username")
+	err := sessions.Delete(username)
+	if err != nil {
+		log.Error("Failed to delete sessions for %s: %v", username, err)
+		http.Error(w, "Failed to logout user", 500)
+		return
+	}
+	log.Info("Admin %s logged out user %s.", c.Username, username)
+	http.Redirect(w, r, "/admin/", 303)
+}
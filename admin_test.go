@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEditUsers(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+	oldAuth := auth
+	auth = &AuthHandler{}
+	defer func() { auth = oldAuth }()
+
+	filename := filepath.Join(dir, usersFileName)
+	disable := func(userList *UserList) error {
+		userList.ByUsername["usernameB"].Disabled = true
+		return nil
+	}
+
+	bad := "# Admins\nusernameA:letmein@admin\nbad line\nusernameB:letmein@g\n"
+	err := ioutil.WriteFile(filename, []byte(bad), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = editUsers(disable); err == nil {
+		t.Error("Edited a users file with a malformed line")
+	}
+	bb, _ := ioutil.ReadFile(filename)
+	if string(bb) != bad {
+		t.Errorf("Users file changed: %q", bb)
+	}
+
+	good := "# Admins\nusernameA:letmein@admin\n\n# Family\nusernameB:letmein@g\n"
+	err = ioutil.WriteFile(filename, []byte(good), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = editUsers(disable); err != nil {
+		t.Fatal(err)
+	}
+	bb, _ = ioutil.ReadFile(filename)
+	lines := strings.Split(string(bb), "\n")
+	if len(lines) != 6 || lines[0] != "# Admins" || lines[2] != "" || lines[3] != "# Family" || !strings.HasPrefix(lines[4], "!usernameB:$2") {
+		t.Errorf("Unexpected users file: %q", bb)
+	}
+	if u := auth.AuthorizedList.ByUsername["usernameB"]; u == nil || !u.Disabled {
+		t.Errorf("Edit not made current: %+v", u)
+	}
+}
+
+// The download role is refused in hideGPS groups rather than ignored.
+func TestCheckDownloadRoles(t *testing.T) {
+	defer func(hide stringList) { hideGPS = hide }(hideGPS)
+	hideGPS = stringList{"g"}
+
+	list := []struct {
+		groups string
+		ok     bool
+	}{
+		{"g", true},
+		{"g+editor", true},
+		{"h+download", true},
+		{"g+download", false},
+		{"h+download,g+uploader+download", false},
+	}
+	for _, item := range list {
+		_, roles, err := parseGroups(item.groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkDownloadRoles(roles)
+		if (err == nil) != item.ok {
+			t.Errorf("%q: error = %v, want ok %t", item.groups, err, item.ok)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const trashFolder = "trash"
+
+var errBadName = errors.New("Bad name")
+
+// albumActions are the album edits allowed to group editors.
+var albumActions = map[string]func(c *Context, r *http.Request, group, album string) (redirect string, err error){
+	"create":   albumCreate,
+	"describe": albumDescribe,
+	"rename":   albumRename,
+	"delete":   albumDelete,
+	"move":     albumMove,
+	"sort":     albumSetSort,
+	"order":    albumSetOrder,
+	"caption":  albumSetCaption,
+	"cover":    albumSetCover,
+}
+
+// /api/album/:group/*album, the album path followed by the action.
+func albumActionHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	var (
+		c      = w.(*Context)
+		group  = vars["group"]
+		album  = strings.Trim(vars["album"], "/")
+		action = path.Base(album)
+	)
+	album = path.Dir(album)
+	fn, found := albumActions[action]
+	if !found || !validAlbum(album) {
+		notFoundAuth(w, r)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	redirect, err := fn(c, r, group, album)
+	if err != nil {
+		log.Error("User %s failed to %s album %s/%s: %v", c.Username, action, group, album, err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	log.Info("User %s: %s album %s/%s.", c.Username, action, group, album)
+	http.Redirect(w, r, redirect, 303)
+}
+
+// albumURL returns the escaped page URL of an album, or of the group if
+// album is empty.
+func albumURL(group, album string) string {
+	u := &url.URL{Path: path.Join("/u", group, album) + "/"}
+	return u.String()
+}
+
+// albumFolder returns the folder of an album path.
+func albumFolder(group, album string) string {
+	return filepath.Join(root, groupsFolder, group, filepath.FromSlash(album))
+}
+
+// subAlbums lists the albums directly inside an album, or in the group if
+// album is empty.
+func subAlbums(group, album string) ([]string, error) {
+	if len(album) == 0 {
+		return getAlbums(group)
+	}
+	return readDirNames(albumFolder(group, album))
+}
+
+// allAlbums lists the paths of every album in the group at any depth,
+// parents before their sub-albums.
+func allAlbums(group string) ([]string, error) {
+	var list []string
+	var walk func(album string) error
+	walk = func(album string) error {
+		names, err := subAlbums(group, album)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			p := path.Join(album, name)
+			list = append(list, p)
+			// Unreadable sub-albums are left out.
+			walk(p)
+		}
+		return nil
+	}
+	err := walk("")
+	return list, err
+}
+
+// albumCreate creates an album, inside an existing album for sub-albums.
+func albumCreate(c *Context, r *http.Request, group, album string) (string, error) {
+	var err error
+	if parent := path.Dir(album); parent == "." {
+		_, err = resolveGroup(group)
+	} else {
+		_, err = resolveAlbum(group, parent)
+	}
+	if err != nil {
+		return "", err
+	}
+	err = os.Mkdir(albumFolder(group, album), 0777)
+	if err != nil {
+		return "", err
+	}
+	return albumURL(group, album), nil
+}
+
+func albumDescribe(c *Context, r *http.Request, group, album string) (string, error) {
+	p, err := resolveAlbum(group, album)
+	if err != nil {
+		return "", err
+	}
+	// Front matter not in the form is kept.
+	desc := readAlbumDesc(p)
+	desc.Title = strings.TrimSpace(r.Form.Get("title"))
+	desc.Body = strings.TrimSpace(strings.Replace(r.Form.Get("body"), "\r\n", "\n", -1))
+	if strings.Contains(desc.Title, "\n") {
+		return "", errors.New("Title must be a single line")
+	}
+	if strings.HasPrefix(desc.Title, frontMatterDelim) {
+		return "", fmt.Errorf("Title must not start with %q", frontMatterDelim)
+	}
+	desc.Hidden = len(r.Form.Get("hidden")) != 0
+	if !desc.Hidden {
+		err = os.Remove(filepath.Join(p, hiddenFile))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	desc.Date = time.Time{}
+	if date := strings.TrimSpace(r.Form.Get("date")); len(date) != 0 {
+		desc.Date, err = time.Parse(descDateFormat, date)
+		if err != nil {
+			return "", fmt.Errorf("Bad date %q", date)
+		}
+	}
+	err = writeFileAtomic(filepath.Join(p, descriptionFile), []byte(desc.String()))
+	if err != nil {
+		return "", err
+	}
+	return albumURL(group, album), nil
+}
+
+// forgetAlbum drops the cached order, stats and listing of a removed or
+// renamed folder and every album below it.
+func forgetAlbum(dir string) {
+	prefix := dir + string(filepath.Separator)
+	below := func(albumPath string) bool {
+		return albumPath == dir || strings.HasPrefix(albumPath, prefix)
+	}
+
+	imageOrdersLock.Lock()
+	for albumPath := range imageOrders {
+		if below(albumPath) {
+			delete(imageOrders, albumPath)
+		}
+	}
+	imageOrdersLock.Unlock()
+
+	albumStatsLock.Lock()
+	for albumPath := range albumStatsList {
+		if below(albumPath) {
+			delete(albumStatsList, albumPath)
+		}
+	}
+	albumStatsLock.Unlock()
+
+	albumListingsLock.Lock()
+	for albumPath := range albumListings {
+		if below(albumPath) {
+			delete(albumListings, albumPath)
+		}
+	}
+	albumListingsLock.Unlock()
+}
+
+func albumRename(c *Context, r *http.Request, group, album string) (string, error) {
+	p, err := resolveAlbum(group, album)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(r.Form.Get("name"))
+	if !validName(name) {
+		return "", errBadName
+	}
+	// Sub-albums are renamed within their parent.
+	renamed := path.Join(path.Dir(album), name)
+	to := albumFolder(group, renamed)
+	if _, err = os.Lstat(to); err == nil {
+		return "", fmt.Errorf("Album %q already exists", name)
+	}
+	err = os.Rename(p, to)
+	if err != nil {
+		return "", err
+	}
+	forgetAlbum(p)
+	return albumURL(group, renamed), nil
+}
+
+// albumDelete moves the album and its sub-albums into the trash folder
+// under root, then returns to the parent album.
+func albumDelete(c *Context, r *http.Request, group, album string) (string, error) {
+	p, err := resolveAlbum(group, album)
+	if err != nil {
+		return "", err
+	}
+	trashed := filepath.Join(root, trashFolder, group, filepath.FromSlash(album)+"-"+time.Now().Format("20060102-150405"))
+	err = os.MkdirAll(filepath.Dir(trashed), 0777)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(p, trashed)
+	if err != nil {
+		return "", err
+	}
+	forgetAlbum(p)
+	parent := path.Dir(album)
+	if parent == "." {
+		parent = ""
+	}
+	return albumURL(group, parent), nil
+}
+
+// albumMove moves the posted images into another album of the same group.
+func albumMove(c *Context, r *http.Request, group, album string) (string, error) {
+	from, err := resolveAlbum(group, album)
+	if err != nil {
+		return "", err
+	}
+	toAlbum := r.Form.Get("to")
+	if !validAlbum(toAlbum) || toAlbum == album {
+		return "", errBadName
+	}
+	to, err := resolveAlbum(group, toAlbum)
+	if err != nil {
+		return "", err
+	}
+	for _, image := range r.Form["image"] {
+		_, _, err = resolveImage(group, album, image)
+		if err != nil {
+			return "", fmt.Errorf("%q: %v", image, err)
+		}
+		dest := filepath.Join(to, image)
+		if _, err = os.Lstat(dest); err == nil {
+			return "", fmt.Errorf("%q already exists in %q", image, toAlbum)
+		}
+		err = os.Rename(filepath.Join(from, image), dest)
+		if err != nil {
+			return "", err
+		}
+		removeCached(from, image)
+		err = os.Rename(captionPath(from, image), captionPath(to, image))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return albumURL(group, album), nil
+}
+
+func albumSetSort(c *Context, r *http.Request, group, album string) (string, error) {
+	p, err := resolveAlbum(group, album)
+	if err != nil {
+		return "", err
+	}
+	mode := r.Form.Get("sort")
+	if !sortModes[mode] {
+		return "", fmt.Errorf("Unknown sort %q", mode)
+	}
+	err = writeAlbumSort(p, mode)
+	if err != nil {
+		return "", err
+	}
+	return albumURL(group, album), nil
+}
+
+// albumSetOrder saves the posted image order. Images added later follow
+// the listed ones.
+func albumSetOrder(c *Context, r *http.Request, group, album string) (string, error) {
+	p, err := resolveAlbum(group, album)
+	if err != nil {
+		return "", err
+	}
+	_, images, err := getImages(p)
+	if err != nil {
+		return "", err
+	}
+	present := make(map[string]bool, len(images))
+	for _, image := range images {
+		present[image] = true
+	}
+	var names []string
+	for _, image := range r.Form["image"] {
+		if !present[image] {
+			return "", fmt.Errorf("%q is not in the album", image)
+		}
+		delete(present, image)
+		names = append(names, image)
+	}
+	err = writeOrderFile(p, names)
+	if err != nil {
+		return "", err
+	}
+	return albumURL(group, album), nil
+}
+
+func albumSetCaption(c *Context, r *http.Request, group, album string) (string, error) {
+	p, err := resolveAlbum(group, album)
+	if err != nil {
+		return "", err
+	}
+	image := r.Form.Get("image")
+	_, _, err = resolveImage(group, album, image)
+	if err != nil {
+		return "", err
+	}
+	caption := strings.TrimSpace(strings.Replace(r.Form.Get("caption"), "\r\n", "\n", -1))
+	err = writeCaption(p, image, caption)
+	if err != nil {
+		return "", err
+	}
+	return albumURL(group, album), nil
+}
+
+func albumSetCover(c *Context, r *http.Request, group, album string) (string, error) {
+	p, err := resolveAlbum(group, album)
+	if err != nil {
+		return "", err
+	}
+	image := r.Form.Get("image")
+	_, _, err = resolveImage(group, album, image)
+	if err != nil {
+		return "", err
+	}
+	err = writeFileAtomic(filepath.Join(p, coverFile), []byte(image+"\n"))
+	if err != nil {
+		return "", err
+	}
+	return albumURL(group, album), nil
+}
+
+// writeFileAtomic replaces filename with data without leaving a partial file.
+func writeFileAtomic(filename string, data []byte) error {
+	return writeAtomic(filename, 0644, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+// writeAtomic calls write with a temporary file next to filename and renames
+// it over filename when write succeeds. The temporary file is removed on error.
+func writeAtomic(filename string, perm os.FileMode, write func(f *os.File) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// albumForm is an album action request with the form already parsed.
+func albumForm(values url.Values) *http.Request {
+	return &http.Request{Method: "POST", Form: values}
+}
+
+// Images not listed in the album must not get a caption file.
+func TestAlbumSetCaption(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+
+	albumPath := filepath.Join(dir, "groups", "g", "a")
+	list := []struct {
+		image string
+		ok    bool
+	}{
+		{"notes.txt", false},
+		{".dot.jpg", false},
+		{"link.jpg", false},
+		{"missing.jpg", false},
+		{"b", false},
+		{"../a/img.jpg", false},
+		{"", false},
+		{"img.jpg", true},
+	}
+	for _, item := range list {
+		r := albumForm(url.Values{"image": {item.image}, "caption": {"A caption"}})
+		_, err := albumSetCaption(&Context{}, r, "g", "a")
+		if (err == nil) != item.ok {
+			t.Errorf("caption %q: error = %v, want ok %t", item.image, err, item.ok)
+		}
+		_, err = os.Stat(captionPath(albumPath, item.image))
+		if (err == nil) != item.ok {
+			t.Errorf("caption %q: caption file written = %t, want %t", item.image, err == nil, item.ok)
+		}
+	}
+}
+
+// Images not listed in the album can not become its cover.
+func TestAlbumSetCover(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+
+	coverPath := filepath.Join(dir, "groups", "g", "a", coverFile)
+	for _, image := range []string{"notes.txt", ".dot.jpg", "link.jpg", "missing.jpg", "b", "../a/img.jpg", ""} {
+		r := albumForm(url.Values{"image": {image}})
+		_, err := albumSetCover(&Context{}, r, "g", "a")
+		if err == nil {
+			t.Errorf("cover %q: want error", image)
+		}
+		if _, err = os.Stat(coverPath); err == nil {
+			t.Fatalf("cover %q: cover file written", image)
+		}
+	}
+	_, err := albumSetCover(&Context{}, albumForm(url.Values{"image": {"img.jpg"}}), "g", "a")
+	if err != nil {
+		t.Fatalf("cover img.jpg: %v", err)
+	}
+	stats, err := getAlbumStats("g", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Cover != "img.jpg" {
+		t.Errorf("Cover = %q, want img.jpg", stats.Cover)
+	}
+}
+
+// Album cards are cached until the album or its description changes.
+func TestAlbumCards(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+
+	albumPath := filepath.Join(dir, "groups", "g", "a")
+	descPath := filepath.Join(albumPath, descriptionFile)
+	card := func() albumCard {
+		cards := newAlbumCards("g", "", []string{"a"}, true)
+		if len(cards) != 1 {
+			t.Fatalf("Got %d cards, want 1", len(cards))
+		}
+		return cards[0]
+	}
+	writeDesc := func(text string, at time.Time) {
+		err := ioutil.WriteFile(descPath, []byte(text), 0644)
+		if err == nil {
+			err = os.Chtimes(descPath, at, at)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	writeDesc("First\n\nBody.\n", now.Add(-time.Minute))
+	if c := card(); c.Title != "First" || c.Hidden {
+		t.Errorf("Got %+v, want title First, visible", c)
+	}
+	writeDesc("---\nhidden: true\n---\nSecond\n\nBody.\n", now)
+	if c := card(); c.Title != "Second" || !c.Hidden {
+		t.Errorf("Got %+v, want title Second, hidden", c)
+	}
+	if cards := newAlbumCards("g", "", []string{"a"}, false); len(cards) != 0 {
+		t.Errorf("Hidden album listed: %+v", cards)
+	}
+	if cards := newAlbumCards("g", "a", []string{"b"}, false); len(cards) != 0 {
+		t.Errorf("Album inside a hidden album listed: %+v", cards)
+	}
+}
+
+// Only listed images are moved, and only into albums of the same group.
+func TestAlbumMove(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+
+	from := filepath.Join(dir, "groups", "g", "a")
+	to := filepath.Join(from, "b")
+	list := []struct {
+		image, to string
+	}{
+		{"notes.txt", "a/b"},
+		{".dot.jpg", "a/b"},
+		{"link.jpg", "a/b"},
+		{"missing.jpg", "a/b"},
+		{"../a/img.jpg", "a/b"},
+		{"img.jpg", "a"},
+		{"img.jpg", "x"},
+		{"img.jpg", "../other/x"},
+		{"img.jpg", "missing"},
+	}
+	for _, item := range list {
+		r := albumForm(url.Values{"image": {item.image}, "to": {item.to}})
+		_, err := albumMove(&Context{}, r, "g", "a")
+		if err == nil {
+			t.Errorf("move %q to %q: want error", item.image, item.to)
+		}
+	}
+	for _, name := range []string{"notes.txt", ".dot.jpg", "img.jpg"} {
+		if _, err := os.Stat(filepath.Join(from, name)); err != nil {
+			t.Errorf("%s moved: %v", name, err)
+		}
+	}
+
+	err := ioutil.WriteFile(captionPath(from, "img.jpg"), []byte("Caption\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = albumMove(&Context{}, albumForm(url.Values{"image": {"img.jpg"}, "to": {"a/b"}}), "g", "a")
+	if err != nil {
+		t.Fatalf("move img.jpg: %v", err)
+	}
+	for _, name := range []string{"img.jpg", "img.jpg" + captionExt} {
+		if _, err := os.Stat(filepath.Join(to, name)); err != nil {
+			t.Errorf("%s not moved: %v", name, err)
+		}
+	}
+}
+
+// Forgetting an album drops it and the albums below it from every cache,
+// but not albums that only share a name prefix.
+func TestForgetAlbum(t *testing.T) {
+	dir := filepath.Join("root", "g", "a")
+	albums := []string{dir, filepath.Join(dir, "b"), dir + "b"}
+	for _, albumPath := range albums {
+		imageOrders[albumPath] = imageOrder{}
+		albumStatsList[albumPath] = cachedStats{}
+		albumListings[albumPath] = albumListing{}
+	}
+	defer forgetAlbum(dir + "b")
+
+	forgetAlbum(dir)
+	for i, albumPath := range albums {
+		_, order := imageOrders[albumPath]
+		_, stats := albumStatsList[albumPath]
+		_, listing := albumListings[albumPath]
+		want := i == 2
+		if order != want || stats != want || listing != want {
+			t.Errorf("%s: cached order %t, stats %t, listing %t, want %t", albumPath, order, stats, listing, want)
+		}
+	}
+}
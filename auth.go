@@ -1,12 +1,14 @@
 package main
 
 import (
+	"crypto/subtle"
 	"net/http"
 	"path/filepath"
 	"sync"
 	"time"
 
 	"bitbucket.org/kardianos/photosite/session"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -18,13 +20,118 @@ var (
 type User struct {
 	Username string
 	Password string
+	Disabled bool
 
 	Groups []string
+	// Roles held by the user, keyed by group.
+	Roles map[string][]string
+}
+
+// InGroup reports if the user is listed in the group.
+func (u *User) InGroup(group string) bool {
+	for _, g := range u.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// isPasswordHash reports if the stored password is a well formed bcrypt
+// hash rather than plain text, which may itself start with "$2".
+func isPasswordHash(password string) bool {
+	_, err := bcrypt.Cost([]byte(password))
+	return err == nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// checkDummyPassword takes as long as checking a real hash so a failed
+// login does not show if the username exists.
+func checkDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("photosite dummy password")
+	})
+	checkPassword(dummyHash, password)
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword compares a stored password, hashed or plain text, against
+// the given password in constant time.
+func checkPassword(stored, password string) bool {
+	if isPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
 }
 
 type UserList struct {
 	Order      []*User
 	ByUsername map[string]*User
+
+	// lines of the users file as read, so comments and skipped lines are
+	// written back unchanged.
+	lines []userLine
+}
+
+// userLine is a user, or a line kept as it was written.
+type userLine struct {
+	user *User
+	text string
+}
+
+// hashPasswords replaces any plain text passwords with hashes and reports
+// if the list changed.
+func (list *UserList) hashPasswords() (bool, error) {
+	changed := false
+	for _, u := range list.Order {
+		if isPasswordHash(u.Password) {
+			continue
+		}
+		hash, err := hashPassword(u.Password)
+		if err != nil {
+			return changed, err
+		}
+		u.Password = hash
+		changed = true
+	}
+	return changed, nil
+}
+
+// clone returns a deep copy of the list that may be edited while the
+// original is still in use.
+func (list *UserList) clone() *UserList {
+	c := &UserList{
+		Order:      make([]*User, len(list.Order)),
+		ByUsername: make(map[string]*User, len(list.Order)),
+	}
+	clones := make(map[*User]*User, len(list.Order))
+	for i, u := range list.Order {
+		cu := *u
+		cu.Groups = append([]string(nil), u.Groups...)
+		cu.Roles = make(map[string][]string, len(u.Roles))
+		for g, roles := range u.Roles {
+			cu.Roles[g] = append([]string(nil), roles...)
+		}
+		c.Order[i] = &cu
+		c.ByUsername[cu.Username] = &cu
+		clones[u] = &cu
+	}
+	c.lines = make([]userLine, len(list.lines))
+	for i, line := range list.lines {
+		c.lines[i] = userLine{user: clones[line.user], text: line.text}
+	}
+	return c
 }
 
 type Context struct {
@@ -32,6 +139,11 @@ type Context struct {
 
 	Username string
 	Groups   []string
+	Roles    map[string][]string
+
+	// Admin is set for members of adminGroup. The admin group is not
+	// listed in Groups.
+	Admin bool
 }
 
 func (c *Context) InGroup(group string) bool {
@@ -43,6 +155,16 @@ func (c *Context) InGroup(group string) bool {
 	return false
 }
 
+// HasRole reports if the user holds the role in the group.
+func (c *Context) HasRole(group, role string) bool {
+	for _, r := range c.Roles[group] {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 type AuthHandler struct {
 	Authorized   http.Handler
 	Unauthorized http.Handler
@@ -53,23 +175,24 @@ type AuthHandler struct {
 
 func (auth *AuthHandler) isValid(username, password string) bool {
 	auth.RLock()
-	defer auth.RUnlock()
-
 	if auth.AuthorizedList == nil {
+		auth.RUnlock()
+		checkDummyPassword(password)
 		return false
 	}
-
 	u, found := auth.AuthorizedList.ByUsername[username]
-	if !found {
-		return false
-	}
-	if u.Username != username || u.Password != password {
+	auth.RUnlock()
+
+	// Hash comparisons are slow, do not hold the lock.
+	if !found || u.Disabled {
+		checkDummyPassword(password)
 		return false
 	}
-
-	return true
+	return checkPassword(u.Password, password)
 }
-func (auth *AuthHandler) groups(username string) []string {
+
+// user returns the named user, or nil if not found or disabled.
+func (auth *AuthHandler) user(username string) *User {
 	auth.RLock()
 	defer auth.RUnlock()
 
@@ -78,11 +201,11 @@ func (auth *AuthHandler) groups(username string) []string {
 	}
 
 	u, found := auth.AuthorizedList.ByUsername[username]
-	if !found {
+	if !found || u.Disabled {
 		return nil
 	}
 
-	return u.Groups
+	return u
 }
 
 func (auth *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -95,19 +218,30 @@ func (auth *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		auth.Unauthorized.ServeHTTP(w, r)
 		return
 	}
-	groups := auth.groups(username)
+	u := auth.user(username)
+	if u == nil {
+		auth.Unauthorized.ServeHTTP(w, r)
+		return
+	}
 
 	c := &Context{
 		ResponseWriter: w,
 		Username:       username,
-		Groups:         groups,
+		Groups:         make([]string, 0, len(u.Groups)),
+		Roles:          u.Roles,
+	}
+	for _, g := range u.Groups {
+		if g == adminGroup {
+			c.Admin = true
+			continue
+		}
+		c.Groups = append(c.Groups, g)
 	}
 	auth.Authorized.ServeHTTP(c, r)
 }
 
 func startExpire() {
-	// Do not make longer then one minute.
-	ticker := time.NewTicker(checkExpireTime)
+	ticker := time.NewTicker(expireInterval())
 	for {
 		<-ticker.C
 		now := time.Now()
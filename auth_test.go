@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestIsPasswordHash(t *testing.T) {
+	hash, err := hashPassword("letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []struct {
+		password string
+		hash     bool
+	}{
+		{hash, true},
+		{"letmein", false},
+		{"$2secret", false},
+		{"$2a$10$short", false},
+		{"", false},
+	}
+	for _, item := range list {
+		if got := isPasswordHash(item.password); got != item.hash {
+			t.Errorf("isPasswordHash(%q) = %t, want %t", item.password, got, item.hash)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// Deduplicates concurrent resizes of the same cache file.
+	cacheFlight singleflight.Group
+
+	// Bounds concurrent resizes, both from workers and requests.
+	resizeSlots chan struct{}
+
+	cacheQueue chan cacheJob
+)
+
+// cacheJob builds every size of one image.
+type cacheJob struct {
+	albumPath string
+	image     string
+
+	// Called when the job finishes, may be nil.
+	done func()
+}
+
+func initCache() {
+	resizeSlots = make(chan struct{}, cacheWorkers)
+	cacheQueue = make(chan cacheJob, 100)
+	findFFmpeg()
+}
+
+// startCacheWorkers starts the resize workers and scans groups for images
+// not yet cached, at start and every cacheScanTime. Scans only compare
+// modification times, "photosite cache verify" decodes the cache files.
+func startCacheWorkers() {
+	for i := 0; i < cacheWorkers; i++ {
+		go cacheWorker()
+	}
+	go func() {
+		scanCache(false)
+		if cacheScanTime <= 0 {
+			return
+		}
+		ticker := time.NewTicker(cacheScanTime)
+		for {
+			<-ticker.C
+			scanCache(false)
+		}
+	}()
+}
+
+func cacheWorker() {
+	for job := range cacheQueue {
+		for _, d := range derivatives() {
+			_, err := cacheImage(job.albumPath, job.image, d)
+			if err == errNoFFmpeg {
+				// Logged once at start.
+				break
+			}
+			if err != nil {
+				log.Warning("Failed to cache %s@%s %s: %v", filepath.Join(job.albumPath, job.image), d.res(), d.format, err)
+			}
+		}
+		updatePhotoInfo(job.albumPath, []string{job.image}, false)
+		if job.done != nil {
+			job.done()
+		}
+	}
+}
+
+// warmCache queues new images so the first viewer does not wait for them.
+func warmCache(group, album string, images []string) {
+	albumPath := albumFolder(group, album)
+	for _, image := range images {
+		cacheQueue <- cacheJob{albumPath: albumPath, image: image}
+	}
+}
+
+// scanCache queues every image missing a cached size and logs progress
+// until they are done.
+func scanCache(verify bool) {
+	jobs := findUncached(verify)
+	if len(jobs) == 0 {
+		return
+	}
+	log.Info("Caching %d images.", len(jobs))
+	start := time.Now()
+
+	var (
+		wg       sync.WaitGroup
+		finished int32
+		total    = int32(len(jobs))
+	)
+	wg.Add(len(jobs))
+	done := func() {
+		n := atomic.AddInt32(&finished, 1)
+		if n%100 == 0 && n != total {
+			log.Info("Cached %d of %d images.", n, total)
+		}
+		wg.Done()
+	}
+	for _, job := range jobs {
+		job.done = done
+		cacheQueue <- job
+	}
+	wg.Wait()
+	log.Info("Cached %d images in %v.", total, time.Since(start))
+}
+
+// forEachAlbum calls fn with the images of every album in every group.
+func forEachAlbum(fn func(albumPath string, images []string)) error {
+	groupsPath := filepath.Join(root, groupsFolder)
+	groups, err := readDirNames(groupsPath)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		albums, err := allAlbums(group)
+		if err != nil {
+			log.Warning("Failed to list albums in %s: %v", group, err)
+			continue
+		}
+		for _, album := range albums {
+			albumPath := albumFolder(group, album)
+			_, images, err := getImages(albumPath)
+			if err != nil {
+				continue
+			}
+			fn(albumPath, images)
+		}
+	}
+	return nil
+}
+
+// findUncached lists images in all albums missing at least one current
+// cached size and removes cache files of deleted images. If verify is set
+// each cache file is decoded and removed if corrupt.
+func findUncached(verify bool) []cacheJob {
+	var jobs []cacheJob
+	err := forEachAlbum(func(albumPath string, images []string) {
+		cleanCache(albumPath, images)
+		updatePhotoInfo(albumPath, images, true)
+		for _, image := range images {
+			if isVideoName(image) && len(ffmpeg) == 0 {
+				continue
+			}
+			src, err := os.Stat(filepath.Join(albumPath, image))
+			if err != nil {
+				continue
+			}
+			if !imageCached(src, albumPath, image, verify) {
+				jobs = append(jobs, cacheJob{albumPath: albumPath, image: image})
+			}
+		}
+	})
+	if err != nil {
+		log.Error("Failed to list groups: %v", err)
+	}
+	return jobs
+}
+
+// imageCached reports if every size and format of the image is cached and
+// current. If verify is set every current cache file is decoded and the
+// corrupt ones are removed before the image is rebuilt, as rebuilding only
+// replaces missing and stale files.
+func imageCached(src os.FileInfo, albumPath, image string, verify bool) bool {
+	cached := true
+	for _, d := range derivatives() {
+		cachePath := cachePathOf(albumPath, image, src.Size(), d)
+		if !cacheValid(src, cachePath) {
+			if !verify {
+				return false
+			}
+			cached = false
+			continue
+		}
+		if verify && !cacheDecodes(cachePath, d.format) {
+			log.Warning("Removing corrupt cache file %s.", cachePath)
+			os.Remove(cachePath)
+			cached = false
+		}
+	}
+	return cached
+}
+
+// cacheDecodes reports if the cache file is a complete image.
+func cacheDecodes(cachePath, format string) bool {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	switch format {
+	case formatWebP:
+		_, err = webp.Decode(f)
+	case formatAVIF:
+		_, err = avif.Decode(f)
+	default:
+		_, err = imaging.Decode(f)
+	}
+	return err == nil
+}
+
+// cleanCache removes cache files that are not a current size and format of
+// any of the images, such as files of deleted images or old settings.
+func cleanCache(albumPath string, images []string) {
+	cachePath := filepath.Join(albumPath, cacheDir)
+	list, err := ioutil.ReadDir(cachePath)
+	if err != nil {
+		return
+	}
+	all := derivatives()
+	expected := make(map[string]bool, len(images)*len(all)+1)
+	expected[photoInfoFile] = true
+	for _, image := range images {
+		src, err := os.Stat(filepath.Join(albumPath, image))
+		if err != nil {
+			continue
+		}
+		for _, d := range all {
+			expected[filepath.Base(cachePathOf(albumPath, image, src.Size(), d))] = true
+		}
+		if isVideoName(image) {
+			expected[filepath.Base(posterPathOf(filepath.Join(albumPath, image), src.Size()))] = true
+		}
+	}
+	for _, fi := range list {
+		name := fi.Name()
+		if expected[name] {
+			continue
+		}
+		// Temporary files being written, unless left by a crash.
+		if name[0] == '.' && time.Since(fi.ModTime()) < time.Hour {
+			continue
+		}
+		err = os.Remove(filepath.Join(cachePath, name))
+		if err == nil {
+			log.Info("Removed orphaned cache file %s.", filepath.Join(cachePath, name))
+		}
+	}
+}
+
+// readDirNames lists the folders in dir that do not start with a ".".
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(list))
+	for _, fi := range list {
+		if fi.IsDir() && fi.Name()[0] != '.' {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifying decodes every cache file of an image, not only the first, and
+// removes the corrupt ones so they are rebuilt.
+func TestImageCachedVerify(t *testing.T) {
+	oldLog, oldSizes, oldSquare, oldFormats, oldSlots := log, sizes, squareSizes, formats, resizeSlots
+	log = consoleLogger{}
+	sizes, squareSizes, formats = intList{8, 16}, nil, nil
+	resizeSlots = make(chan struct{}, 1)
+	defer func() {
+		log, sizes, squareSizes, formats, resizeSlots = oldLog, oldSizes, oldSquare, oldFormats, oldSlots
+	}()
+
+	albumPath, err := ioutil.TempDir("", "photosite-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(albumPath)
+
+	f, err := os.Create(filepath.Join(albumPath, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(f, image.NewGray(image.Rect(0, 0, 32, 32)))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.Stat(filepath.Join(albumPath, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cached []string
+	for _, d := range derivatives() {
+		cachePath, err := cacheImage(albumPath, "a.png", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached = append(cached, cachePath)
+	}
+	if !imageCached(src, albumPath, "a.png", true) {
+		t.Fatal("Freshly cached image is not cached")
+	}
+
+	// Corrupt every cache file, keeping the modification time.
+	for _, cachePath := range cached {
+		err = ioutil.WriteFile(cachePath, []byte("corrupt"), 0644)
+		if err == nil {
+			err = os.Chtimes(cachePath, src.ModTime(), src.ModTime())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !imageCached(src, albumPath, "a.png", false) {
+		t.Error("Scan without verify decoded cache files")
+	}
+	if imageCached(src, albumPath, "a.png", true) {
+		t.Error("Corrupt cache files verified")
+	}
+	for _, cachePath := range cached {
+		if _, err := os.Stat(cachePath); err == nil {
+			t.Errorf("Corrupt cache file %s not removed", filepath.Base(cachePath))
+		}
+	}
+}
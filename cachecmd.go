@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const cacheCommandUsage = `Usage: %s [flags] cache <command>
+	verify	decode every cache file, rebuild missing, stale and corrupt files
+	purge	remove every cache folder
+`
+
+// runCacheCommand repairs the image cache from the command line.
+func runCacheCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf(cacheCommandUsage, os.Args[0])
+	}
+	err := loadSettings()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "verify":
+		initCache()
+		for i := 0; i < cacheWorkers; i++ {
+			go cacheWorker()
+		}
+		scanCache(true)
+		return nil
+	case "purge":
+		var purgeErr error
+		err = forEachAlbum(func(albumPath string, images []string) {
+			cachePath := filepath.Join(albumPath, cacheDir)
+			if _, err := os.Stat(cachePath); err != nil {
+				return
+			}
+			err := os.RemoveAll(cachePath)
+			if err != nil {
+				purgeErr = err
+				return
+			}
+			log.Info("Removed %s.", cachePath)
+		})
+		if err != nil {
+			return err
+		}
+		return purgeErr
+	}
+	return fmt.Errorf(cacheCommandUsage, os.Args[0])
+}
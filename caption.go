@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Captions are kept next to their image: imgA.jpg.txt. An empty caption
+// file hides the caption read from the image.
+const captionExt = ".txt"
+
+// Generic descriptions some cameras write to every image.
+var cameraDescriptions = map[string]bool{
+	"OLYMPUS DIGITAL CAMERA": true,
+	"SONY DSC":               true,
+	"DCIM":                   true,
+	"DIGITAL CAMERA":         true,
+}
+
+// XMP packets are in the first part of most images.
+const xmpSearchSize = 1 << 20
+
+func captionPath(albumPath, image string) string {
+	return filepath.Join(albumPath, image+captionExt)
+}
+
+// readCaptions returns the caption of each image from its caption file, or
+// from the EXIF description or XMP title of the image.
+func readCaptions(albumPath string, images []string, info map[string]photoInfo) map[string]string {
+	f, err := os.Open(albumPath)
+	if err != nil {
+		return nil
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil
+	}
+	sidecars := make(map[string]bool, len(names))
+	for _, name := range names {
+		if strings.HasSuffix(name, captionExt) {
+			sidecars[name] = true
+		}
+	}
+	captions := make(map[string]string, len(images))
+	for _, image := range images {
+		if sidecars[image+captionExt] {
+			bb, err := ioutil.ReadFile(captionPath(albumPath, image))
+			if err == nil {
+				captions[image] = strings.TrimSpace(string(bb))
+				continue
+			}
+		}
+		captions[image] = info[image].caption()
+	}
+	return captions
+}
+
+// caption is the description the image was saved with, if any.
+func (info photoInfo) caption() string {
+	if len(info.Description) != 0 && !cameraDescriptions[strings.ToUpper(info.Description)] {
+		return info.Description
+	}
+	return info.Title
+}
+
+func writeCaption(albumPath, image, caption string) error {
+	return writeFileAtomic(captionPath(albumPath, image), []byte(caption+"\n"))
+}
+
+// readXMPTitle returns the Dublin Core title of the XMP packet in the file.
+func readXMPTitle(filename string) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	bb, err := ioutil.ReadAll(io.LimitReader(f, xmpSearchSize))
+	if err != nil {
+		return ""
+	}
+	start := bytes.Index(bb, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return ""
+	}
+	end := bytes.Index(bb[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return ""
+	}
+	return xmpTitle(bb[start : start+end+len("</x:xmpmeta>")])
+}
+
+// xmpTitle finds the first dc:title alternative: <dc:title><rdf:Alt>
+// <rdf:li xml:lang="x-default">Title</rdf:li></rdf:Alt></dc:title>.
+func xmpTitle(packet []byte) string {
+	const dcNamespace = "http://purl.org/dc/elements/1.1/"
+	d := xml.NewDecoder(bytes.NewReader(packet))
+	inTitle := false
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Space == dcNamespace && t.Name.Local == "title" {
+				inTitle = true
+			}
+		case xml.EndElement:
+			if t.Name.Space == dcNamespace && t.Name.Local == "title" {
+				return ""
+			}
+		case xml.CharData:
+			if inTitle {
+				if title := strings.TrimSpace(string(t)); len(title) != 0 {
+					return title
+				}
+			}
+		}
+	}
+}
@@ -5,73 +5,175 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 )
 
-func UserDecode(r io.Reader, v interface{}) error {
-	userList, isValue := v.(*UserList)
-	if !isValue {
-		return fmt.Errorf("Incoming value is not of type: *UserList")
+// UserLineError is a malformed line in the users file.
+type UserLineError struct {
+	Line int
+	Err  error
+}
+
+func (e *UserLineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func validUsername(username string) error {
+	if len(username) < minUsernameLength {
+		return fmt.Errorf("Username must at least %d letters", minUsernameLength)
 	}
-	b, err := ioutil.ReadAll(r)
-	if err != nil {
-		return err
+	if strings.ContainsAny(username, ":@,#! \t") {
+		return fmt.Errorf("Username may not contain spaces or any of \":@,#!\"")
 	}
-	b = bytes.Trim(b, " \t\n\r")
+	return nil
+}
+
+func validPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("Password must at least %d letters", minPasswordLength)
+	}
+	if strings.ContainsAny(password, "@\n") {
+		return fmt.Errorf("Password may not contain \"@\" or new lines")
+	}
+	return nil
+}
+
+// Roles a user may hold within a group, written after the group name:
+// groupA+uploader.
+const (
+	roleUploader   = "uploader"
+	roleEditor     = "editor"
+	roleDownloader = "download"
+)
+
+var knownRoles = map[string]bool{
+	roleUploader:   true,
+	roleEditor:     true,
+	roleDownloader: true,
+}
+
+// parseGroups splits a comma separated group list. Each group may be
+// followed by "+role" entries.
+func parseGroups(list string) (groups []string, roles map[string][]string, err error) {
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.Split(item, "+")
+		g := parts[0]
+		if len(g) == 0 {
+			return nil, nil, fmt.Errorf("Empty group name")
+		}
+		if g[0] == '.' || strings.ContainsAny(g, ":@/\\ \t") {
+			return nil, nil, fmt.Errorf("Bad group name %q", g)
+		}
+		for _, role := range parts[1:] {
+			if !knownRoles[role] {
+				return nil, nil, fmt.Errorf("Unknown role %q for group %q", role, g)
+			}
+			if roles == nil {
+				roles = make(map[string][]string)
+			}
+			roles[g] = append(roles[g], role)
+		}
+		groups = append(groups, g)
+	}
+	return groups, roles, nil
+}
+
+func formatGroups(groups []string, roles map[string][]string) string {
+	list := make([]string, len(groups))
+	for i, g := range groups {
+		list[i] = strings.Join(append([]string{g}, roles[g]...), "+")
+	}
+	return strings.Join(list, ",")
+}
+
+// decodeUsers parses the users file into userList. Malformed lines are
+// skipped and returned as *UserLineError. Comments, blank and malformed
+// lines are kept to be written back as they were.
+func decodeUsers(b []byte, userList *UserList) []error {
 	lines := bytes.Split(b, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
 
-	userList.Order = make([]*User, len(lines))
+	userList.Order = make([]*User, 0, len(lines))
 	userList.ByUsername = make(map[string]*User, len(lines))
+	userList.lines = make([]userLine, len(lines))
 
-	i := 0
-	for _, line := range lines {
+	var errs []error
+	bad := func(lineIndex int, format string, a ...interface{}) {
+		errs = append(errs, &UserLineError{Line: lineIndex + 1, Err: fmt.Errorf(format, a...)})
+	}
+	for lineIndex, line := range lines {
+		userList.lines[lineIndex].text = string(line)
+		line = bytes.Trim(line, " \t\r")
 		if len(line) == 0 || line[0] == byte('#') {
 			continue
 		}
+		disabled := line[0] == '!'
+		if disabled {
+			line = line[1:]
+		}
 		passwordIndex := bytes.IndexRune(line, ':')
 		groupsIndex := bytes.IndexRune(line, '@')
 		if passwordIndex <= 0 {
+			bad(lineIndex, "Missing \"username:\"")
 			continue
 		}
-		if groupsIndex <= 0 {
+		if groupsIndex <= 0 || groupsIndex < passwordIndex {
+			bad(lineIndex, "Missing \"@groups\" after password")
 			continue
 		}
-		if groupsIndex < passwordIndex {
-			continue
-		}
-		username := line[:passwordIndex]
-		password := line[passwordIndex+1 : groupsIndex]
-		groups := line[groupsIndex+1:]
-
-		groupList := bytes.Split(groups, []byte(","))
+		username := string(line[:passwordIndex])
+		password := string(line[passwordIndex+1 : groupsIndex])
 
-		if len(groupList) == 0 {
+		if err := validUsername(username); err != nil {
+			bad(lineIndex, "%v", err)
 			continue
 		}
-		if len(username) < minUsernameLength {
-			log.Error("Username must at least %d letters", minUsernameLength)
+		if !isPasswordHash(password) {
+			if err := validPassword(password); err != nil {
+				bad(lineIndex, "%v", err)
+				continue
+			}
+		}
+		groups, roles, err := parseGroups(string(line[groupsIndex+1:]))
+		if err != nil {
+			bad(lineIndex, "%v", err)
 			continue
 		}
-		if len(password) < minPasswordLength {
-			log.Error("Password must at least %d letters", minPasswordLength)
+		if _, found := userList.ByUsername[username]; found {
+			bad(lineIndex, "Duplicate username %q", username)
 			continue
 		}
 
 		u := &User{
-			Username: string(username),
-			Password: string(password),
-			Groups:   make([]string, len(groupList)),
+			Username: username,
+			Password: password,
+			Disabled: disabled,
+			Groups:   groups,
+			Roles:    roles,
 		}
-		for gi, g := range groupList {
-			u.Groups[gi] = string(g)
-		}
-		userList.Order[i] = u
+		userList.Order = append(userList.Order, u)
 		userList.ByUsername[u.Username] = u
-
-		i++
+		userList.lines[lineIndex].user = u
 	}
-	userList.Order = userList.Order[:i]
 
+	return errs
+}
+
+func UserDecode(r io.Reader, v interface{}) error {
+	userList, isValue := v.(*UserList)
+	if !isValue {
+		return fmt.Errorf("Incoming value is not of type: *UserList")
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for _, err := range decodeUsers(b, userList) {
+		log.Error("Skipping %s %v", usersFileName, err)
+	}
 	return nil
 }
 
@@ -80,12 +182,51 @@ func UserEncode(w io.Writer, v interface{}) error {
 	if !isValue {
 		return fmt.Errorf("Incoming value is not of type: *UserList")
 	}
+	// Users keep their line, removed users lose it and new users follow
+	// every line read.
+	written := make(map[*User]bool, len(userList.Order))
+	for _, line := range userList.lines {
+		text := line.text
+		if line.user != nil {
+			if userList.ByUsername[line.user.Username] != line.user {
+				continue
+			}
+			text = formatUser(line.user)
+			written[line.user] = true
+		}
+		_, err := io.WriteString(w, text+"\n")
+		if err != nil {
+			return err
+		}
+	}
 	for _, user := range userList.Order {
-		line := fmt.Sprintf("%s:%s@%s\n", user.Username, user.Password, strings.Join(user.Groups, ","))
-		_, err := io.WriteString(w, line)
+		if written[user] {
+			continue
+		}
+		_, err := io.WriteString(w, formatUser(user)+"\n")
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func formatUser(user *User) string {
+	disabled := ""
+	if user.Disabled {
+		disabled = "!"
+	}
+	return fmt.Sprintf("%s%s:%s@%s", disabled, user.Username, user.Password, formatGroups(user.Groups, user.Roles))
+}
+
+// saveUsers writes the user list to a temporary file and renames it over
+// filename so the watcher never sees a partial file.
+func saveUsers(filename string, userList *UserList) error {
+	return writeAtomic(filename, 0600, func(f *os.File) error {
+		err := UserEncode(f, userList)
+		if err != nil {
+			return err
+		}
+		return f.Sync()
+	})
+}
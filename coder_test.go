@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeUsers(t *testing.T) {
+	in := []byte(`# Comment
+usernameA:letmein@g1,g2
+
+usernameB@g1
+usernameC:short@g1
+usernameD:letmein@
+usernameA:letmein@g3
+`)
+	userList := &UserList{}
+	errs := decodeUsers(in, userList)
+
+	if len(userList.Order) != 1 || userList.Order[0].Username != "usernameA" {
+		t.Fatalf("Unexpected users: %v", userList.Order)
+	}
+	lines := []int{}
+	for _, err := range errs {
+		lines = append(lines, err.(*UserLineError).Line)
+	}
+	if !reflect.DeepEqual(lines, []int{4, 5, 6, 7}) {
+		t.Errorf("Unexpected error lines: %v", lines)
+	}
+
+	buf := &bytes.Buffer{}
+	err := UserEncode(buf, userList)
+	if err != nil {
+		t.Fatalf("Encode error: %v", err)
+	}
+	// Comments and skipped lines are written back unchanged.
+	if buf.String() != string(in) {
+		t.Errorf("Unexpected encoding: %q", buf.String())
+	}
+}
+
+func TestEncodeEditedUsers(t *testing.T) {
+	in := []byte("# Admins\r\nusernameA:letmein@admin\n\n# Family\nusernameB:letmein@g1\nbad line\nusernameC:letmein@g1")
+	userList := &UserList{}
+	decodeUsers(in, userList)
+	edited := userList.clone()
+
+	edited.ByUsername["usernameA"].Disabled = true
+	edited.ByUsername["usernameC"].Groups = []string{"g1", "g2"}
+	delete(edited.ByUsername, "usernameB")
+	edited.Order = []*User{edited.ByUsername["usernameA"], edited.ByUsername["usernameC"]}
+	u := &User{Username: "usernameD", Password: "letmein", Groups: []string{"g2"}}
+	edited.Order = append(edited.Order, u)
+	edited.ByUsername[u.Username] = u
+
+	buf := &bytes.Buffer{}
+	err := UserEncode(buf, edited)
+	if err != nil {
+		t.Fatalf("Encode error: %v", err)
+	}
+	want := "# Admins\r\n!usernameA:letmein@admin\n\n# Family\nbad line\nusernameC:letmein@g1,g2\nusernameD:letmein@g2\n"
+	if buf.String() != want {
+		t.Errorf("Got %q, want %q", buf.String(), want)
+	}
+
+	// The original list is unchanged.
+	buf.Reset()
+	UserEncode(buf, userList)
+	if buf.String() != string(in)+"\n" {
+		t.Errorf("Original changed: %q", buf.String())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+)
+
+// Square crop modes.
+const (
+	cropCenter = "center"
+	cropSmart  = "smart"
+)
+
+// Width of the preview used to find the busiest part of an image.
+const cropPreviewSize = 128
+
+// cropSquare fills size by size from the image, cropping the longer side
+// either at the center or around the most detailed area.
+func cropSquare(img image.Image, size int, filter imaging.ResampleFilter) *image.NRGBA {
+	if squareCrop != cropSmart {
+		return imaging.Fill(img, size, size, imaging.Center, filter)
+	}
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	offset := detailOffset(img)
+	var r image.Rectangle
+	if b.Dx() > b.Dy() {
+		x := b.Min.X + int(offset*float64(b.Dx()-side))
+		r = image.Rect(x, b.Min.Y, x+side, b.Max.Y)
+	} else {
+		y := b.Min.Y + int(offset*float64(b.Dy()-side))
+		r = image.Rect(b.Min.X, y, b.Max.X, y+side)
+	}
+	return imaging.Resize(imaging.Crop(img, r), size, size, filter)
+}
+
+// detailOffset returns where, from 0 to 1 along the longer side, a square
+// window covers the most edge detail.
+func detailOffset(img image.Image) float64 {
+	preview := imaging.Grayscale(imaging.Fit(img, cropPreviewSize, cropPreviewSize, imaging.Box))
+	b := preview.Bounds()
+	w, h := b.Dx(), b.Dy()
+	horizontal := w > h
+	length, side := h, w
+	if horizontal {
+		length, side = w, h
+	}
+	if length <= side {
+		return 0.5
+	}
+
+	gray := func(x, y int) int {
+		return int(color.GrayModel.Convert(preview.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y)
+	}
+	abs := func(v int) int {
+		if v < 0 {
+			return -v
+		}
+		return v
+	}
+	// Edge energy of each line across the longer side.
+	energy := make([]int, length)
+	for y := 1; y < h; y++ {
+		for x := 1; x < w; x++ {
+			g := gray(x, y)
+			e := abs(g-gray(x-1, y)) + abs(g-gray(x, y-1))
+			if horizontal {
+				energy[x] += e
+			} else {
+				energy[y] += e
+			}
+		}
+	}
+
+	sum := 0
+	for i := 0; i < side; i++ {
+		sum += energy[i]
+	}
+	best, bestAt := sum, 0
+	for i := side; i < length; i++ {
+		sum += energy[i] - energy[i-side]
+		if sum > best {
+			best, bestAt = sum, i-side+1
+		}
+	}
+	if best == 0 {
+		return 0.5
+	}
+	return float64(bestAt) / float64(length-side)
+}
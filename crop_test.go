@@ -0,0 +1,45 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// testDetailImage is flat gray except for a checkerboard in detail.
+func testDetailImage(w, h int, detail image.Rectangle) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := uint8(128)
+			if (image.Point{x, y}).In(detail) {
+				c = uint8((x/4+y/4)%2) * 255
+			}
+			img.SetGray(x, y, color.Gray{Y: c})
+		}
+	}
+	return img
+}
+
+func TestDetailOffset(t *testing.T) {
+	list := []struct {
+		name   string
+		img    image.Image
+		offset float64
+	}{
+		{"flat", testDetailImage(300, 100, image.Rectangle{}), 0.5},
+		{"square", testDetailImage(100, 100, image.Rect(0, 0, 50, 50)), 0.5},
+		{"left", testDetailImage(300, 100, image.Rect(0, 0, 100, 100)), 0},
+		{"right", testDetailImage(300, 100, image.Rect(200, 0, 300, 100)), 1},
+		{"middle", testDetailImage(300, 100, image.Rect(100, 0, 200, 100)), 0.5},
+		{"top", testDetailImage(100, 300, image.Rect(0, 0, 100, 100)), 0},
+		{"bottom", testDetailImage(100, 300, image.Rect(0, 200, 100, 300)), 1},
+	}
+	for _, item := range list {
+		got := detailOffset(item.img)
+		if math.Abs(got-item.offset) > 0.05 {
+			t.Errorf("%s: detailOffset = %.3f, want %.3f", item.name, got, item.offset)
+		}
+	}
+}
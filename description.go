@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+)
+
+// hiddenFile marks an album as a draft, like "hidden: true" front matter.
+const hiddenFile = ".hidden"
+
+// frontMatterDelim surrounds the optional settings at the start of the
+// description file:
+//
+//	---
+//	date: 2014-06-01
+//	cover: imgA.jpg
+//	sort: date
+//	hidden: true
+//	---
+//	Title
+//
+//	Markdown body.
+const frontMatterDelim = "---"
+
+const descDateFormat = "2006-01-02"
+
+// Markdown renders without raw HTML and drops dangerous link schemes.
+var markdown = goldmark.New()
+
+// albumDesc is the parsed album description file.
+type albumDesc struct {
+	Title string
+	// Body is Markdown.
+	Body string
+
+	Date   time.Time
+	Cover  string
+	Sort   string
+	Hidden bool
+}
+
+// albumHidden reports if the album or any album containing it is hidden
+// from viewers.
+func albumHidden(group, album string) bool {
+	for p := album; p != "." && p != "/" && len(p) != 0; p = path.Dir(p) {
+		if hiddenFolder(albumFolder(group, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenFolder reports if the album folder itself is marked hidden.
+func hiddenFolder(albumPath string) bool {
+	if readAlbumDesc(albumPath).Hidden {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(albumPath, hiddenFile))
+	return err == nil
+}
+
+func readAlbumDesc(albumPath string) albumDesc {
+	bb, err := ioutil.ReadFile(filepath.Join(albumPath, descriptionFile))
+	if err != nil {
+		return albumDesc{}
+	}
+	return parseDescription(string(bb))
+}
+
+// parseDescription splits the front matter, then the title from the body
+// on the first blank line. Bad front matter lines are logged and skipped.
+func parseDescription(text string) albumDesc {
+	var d albumDesc
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if strings.HasPrefix(text, frontMatterDelim+"\n") {
+		// Wrapped in new lines so the closing line may directly follow the
+		// opening one or end the file.
+		rest := "\n" + text[len(frontMatterDelim)+1:] + "\n"
+		end := strings.Index(rest, "\n"+frontMatterDelim+"\n")
+		if end >= 0 {
+			d.parseFrontMatter(rest[:end])
+			text = rest[end+len(frontMatterDelim)+2:]
+		}
+	}
+	text = strings.Trim(text, " \n\t")
+	titleAt := strings.Index(text, "\n\n")
+	if titleAt > 0 {
+		d.Title = text[:titleAt]
+		d.Body = text[titleAt+2:]
+	} else {
+		d.Body = text
+	}
+	return d
+}
+
+func (d *albumDesc) parseFrontMatter(text string) {
+	s := bufio.NewScanner(strings.NewReader(text))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		at := strings.Index(line, ":")
+		if at < 0 {
+			log.Warning("Bad description front matter line %q.", line)
+			continue
+		}
+		key := strings.TrimSpace(line[:at])
+		value := strings.Trim(strings.TrimSpace(line[at+1:]), `"'`)
+		var err error
+		switch key {
+		case "date":
+			d.Date, err = time.Parse(descDateFormat, value)
+		case "cover":
+			d.Cover = value
+		case "sort":
+			if !sortModes[value] {
+				err = fmt.Errorf("unknown sort")
+			}
+			d.Sort = value
+		case "hidden":
+			d.Hidden, err = strconv.ParseBool(value)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			log.Warning("Bad description front matter %q: %v", line, err)
+		}
+	}
+}
+
+// String formats the description file, with front matter only if set.
+func (d albumDesc) String() string {
+	var buf bytes.Buffer
+	var front []string
+	if !d.Date.IsZero() {
+		front = append(front, "date: "+d.Date.Format(descDateFormat))
+	}
+	if len(d.Cover) != 0 {
+		front = append(front, "cover: "+d.Cover)
+	}
+	if len(d.Sort) != 0 {
+		front = append(front, "sort: "+d.Sort)
+	}
+	if d.Hidden {
+		front = append(front, "hidden: true")
+	}
+	if len(front) != 0 {
+		buf.WriteString(frontMatterDelim + "\n" + strings.Join(front, "\n") + "\n" + frontMatterDelim + "\n")
+	}
+	if len(d.Title) != 0 {
+		buf.WriteString(d.Title + "\n\n")
+	}
+	buf.WriteString(d.Body + "\n")
+	return buf.String()
+}
+
+// BodyHTML renders the Markdown body. Raw HTML in the body is left out.
+func (d albumDesc) BodyHTML() template.HTML {
+	var buf bytes.Buffer
+	err := markdown.Convert([]byte(d.Body), &buf)
+	if err != nil {
+		return template.HTML(template.HTMLEscapeString(d.Body))
+	}
+	return template.HTML(buf.String())
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDescription(t *testing.T) {
+	oldLog := log
+	log = consoleLogger{}
+	defer func() { log = oldLog }()
+
+	date := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	list := []struct {
+		name string
+		text string
+		d    albumDesc
+	}{
+		{"empty", "", albumDesc{}},
+		{"body", "Just a body.\n", albumDesc{Body: "Just a body."}},
+		{"title", "Title\n\nBody *text*.\n", albumDesc{Title: "Title", Body: "Body *text*."}},
+		{"crlf", "Title\r\n\r\nBody.\r\n", albumDesc{Title: "Title", Body: "Body."}},
+		{
+			"front matter",
+			"---\ndate: 2014-06-01\ncover: \"imgA.jpg\"\nsort: name\nhidden: true\n---\nTitle\n\nBody.\n",
+			albumDesc{Title: "Title", Body: "Body.", Date: date, Cover: "imgA.jpg", Sort: "name", Hidden: true},
+		},
+		{"closing fence at end", "---\nhidden: true\n---", albumDesc{Hidden: true}},
+		{"empty front matter", "---\n---\nTitle\n\nBody.", albumDesc{Title: "Title", Body: "Body."}},
+		{"unclosed front matter", "---\nhidden: true\n", albumDesc{Body: "---\nhidden: true"}},
+		{"fence in body", "Title\n\n---\nhidden: true\n---\n", albumDesc{Title: "Title", Body: "---\nhidden: true\n---"}},
+		{"bad lines skipped", "---\nbad\ndate: june\nsort: random\ncolor: red\ncover: a.jpg\n---\n", albumDesc{Cover: "a.jpg", Sort: "random"}},
+	}
+	for _, item := range list {
+		d := parseDescription(item.text)
+		if d != item.d {
+			t.Errorf("%s: got %+v, want %+v", item.name, d, item.d)
+		}
+		// Formatting and parsing again keeps every field.
+		if again := parseDescription(d.String()); again != d {
+			t.Errorf("%s: round trip got %+v, want %+v", item.name, again, d)
+		}
+	}
+}
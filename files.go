@@ -2,24 +2,27 @@ package main
 
 import (
 	"errors"
+	"image"
+	"image/gif"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/disintegration/imaging"
+	"github.com/gen2brain/heic"
 	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
+// getAlbums lists the album folders of a group, leaving out files and
+// names starting with a ".".
 func getAlbums(group string) ([]string, error) {
-	groupPath := filepath.Join(root, groupsFolder, group)
-	f, err := os.Open(groupPath)
-	if err != nil {
-		return nil, err
-	}
-	return f.Readdirnames(-1)
+	return readDirNames(filepath.Join(root, groupsFolder, group))
 }
 
 type sortFileInfo []os.FileInfo
@@ -28,30 +31,27 @@ func (s sortFileInfo) Len() int           { return len(s) }
 func (s sortFileInfo) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s sortFileInfo) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
 
-func getImages(group, album string) (string, []string, error) {
-	albumPath := filepath.Join(root, groupsFolder, group, album)
-	f, err := os.Open(albumPath)
-	if err != nil {
-		return "", nil, err
-	}
-	files, err := f.Readdir(-1)
+// getImages reads the description and lists the images of a resolved album
+// folder in album order. A RAW file with a JPEG of the same name is left
+// out, the JPEG shows the shot and the RAW is downloaded from it.
+func getImages(albumPath string) (string, []string, error) {
+	files, err := albumFiles(albumPath)
 	if err != nil {
 		return "", nil, err
 	}
-	var images []string
-	sort.Sort(sortFileInfo(files))
+	var images []os.FileInfo
 	description := ""
 	if len(files) != 0 {
-		images = make([]string, 0, len(files)-1)
+		images = make([]os.FileInfo, 0, len(files)-1)
 	}
+	jpegs := make(map[string]bool)
 	for _, fi := range files {
-		if fi.IsDir() {
-			continue
+		if isJPEGName(fi.Name()) {
+			jpegs[shotKey(fi.Name())] = true
 		}
+	}
+	for _, fi := range files {
 		name := fi.Name()
-		if name[0] == '.' {
-			continue
-		}
 		if name == descriptionFile {
 			bb, err := ioutil.ReadFile(filepath.Join(albumPath, name))
 			if err != nil {
@@ -59,108 +59,328 @@ func getImages(group, album string) (string, []string, error) {
 			}
 			description = string(bb)
 		}
-		lname := strings.ToLower(name)
+		if !isImageName(name) || isRawName(name) && jpegs[shotKey(name)] {
+			continue
+		}
+		images = append(images, fi)
+	}
+	return description, sortImages(albumPath, images), nil
+}
 
-		isImage := false
-		isImage = isImage || strings.HasSuffix(lname, ".jpg")
-		isImage = isImage || strings.HasSuffix(lname, ".jpeg")
-		isImage = isImage || strings.HasSuffix(lname, ".png")
-		if !isImage {
+// albumFiles lists the files of an album folder, leaving out folders and
+// names starting with a ".".
+func albumFiles(albumPath string) ([]os.FileInfo, error) {
+	f, err := os.Open(albumPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	files := list[:0]
+	for _, fi := range list {
+		if fi.IsDir() || fi.Name()[0] == '.' {
 			continue
 		}
-		images = append(images, name)
+		files = append(files, fi)
+	}
+	return files, nil
+}
+
+// sourceDecoder reads one kind of original into an image.
+type sourceDecoder struct {
+	decode func(filename string) (image.Image, error)
+	// webExt is the extension of cached sizes: the source extension for
+	// formats browsers show, otherwise ".jpg" or ".png".
+	webExt string
+}
+
+// sourceDecoders are keyed by lower case file extension.
+var sourceDecoders = map[string]sourceDecoder{}
+
+var errNoPreview = errors.New("No embedded preview image")
+
+func registerDecoder(decode func(filename string) (image.Image, error), webExt string, exts ...string) {
+	for _, ext := range exts {
+		sourceDecoders[ext] = sourceDecoder{decode: decode, webExt: webExt}
+	}
+}
+
+func init() {
+	registerDecoder(openImage, "", ".jpg", ".jpeg", ".png")
+	// Animated GIF decode to their first frame.
+	registerDecoder(decodeWith(gif.Decode), ".png", ".gif")
+	registerDecoder(decodeWith(bmp.Decode), ".jpg", ".bmp")
+	registerDecoder(decodeWith(tiff.Decode), ".jpg", ".tif", ".tiff")
+	registerDecoder(decodeWith(heic.Decode), ".jpg", ".heic", ".heif")
+}
+
+func openImage(filename string) (image.Image, error) {
+	return imaging.Open(filename)
+}
+
+func decodeWith(decode func(r io.Reader) (image.Image, error)) func(filename string) (image.Image, error) {
+	return func(filename string) (image.Image, error) {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return decode(f)
+	}
+}
+
+func lookupDecoder(name string) (sourceDecoder, bool) {
+	d, found := sourceDecoders[strings.ToLower(filepath.Ext(name))]
+	return d, found
+}
+
+func isImageName(name string) bool {
+	_, found := lookupDecoder(name)
+	return found
+}
+
+func decodeSource(filename string) (image.Image, error) {
+	d, found := lookupDecoder(filename)
+	if !found {
+		return nil, errors.New("No decoder for " + filepath.Ext(filename))
+	}
+	return d.decode(filename)
+}
+
+// webExt returns the extension cached sizes of the image are saved with.
+func webExt(image string) string {
+	d, _ := lookupDecoder(image)
+	if len(d.webExt) == 0 {
+		return filepath.Ext(image)
+	}
+	return d.webExt
+}
+
+// removeCached deletes the cached sizes of an image.
+func removeCached(albumPath, image string) {
+	cachePath := filepath.Join(albumPath, cacheDir)
+	names, err := ioutil.ReadDir(cachePath)
+	if err != nil {
+		return
+	}
+	prefix := image + "@"
+	for _, fi := range names {
+		if strings.HasPrefix(fi.Name(), prefix) {
+			os.Remove(filepath.Join(cachePath, fi.Name()))
+		}
 	}
-	// sort.StringSlice(images).Sort()
-	return description, images, nil
 }
 
 var badImageSize = errors.New("Bad image size")
 
-func getSingleImage(group, album, res, image string) (string, error) {
+// derivative is one cached version of an image.
+type derivative struct {
+	size int
+	// Square derivatives are cropped to fill size by size.
+	square bool
+	format string
+}
+
+// res is the name of the derivative in URLs: "200" or "sq200".
+func (d derivative) res() string {
+	if d.square {
+		return "sq" + strconv.Itoa(d.size)
+	}
+	return strconv.Itoa(d.size)
+}
+
+// key names the settings the derivative is built with, so cache files built
+// with other settings are not used.
+func (d derivative) key() string {
+	key := resampling.forSize(d.size).key()
+	if d.square {
+		key = squareCrop + "-" + key
+	}
+	return key
+}
+
+// derivatives lists every configured size, square size and format.
+func derivatives() []derivative {
+	var list []derivative
+	for _, format := range cachedFormats() {
+		for _, size := range sizes {
+			list = append(list, derivative{size: size, format: format})
+		}
+		for _, size := range squareSizes {
+			list = append(list, derivative{size: size, square: true, format: format})
+		}
+	}
+	return list
+}
+
+// parseRes reads a derivative size from a URL, allowing only configured sizes.
+func parseRes(res, format string) (derivative, error) {
+	d := derivative{format: format}
+	if strings.HasPrefix(res, "sq") {
+		d.square = true
+		res = res[2:]
+	}
 	size, err := strconv.Atoi(res)
+	if err != nil {
+		return d, err
+	}
+	d.size = size
+	if d.square && !squareSizes.contains(size) || !d.square && !sizes.contains(size) {
+		return d, badImageSize
+	}
+	return d, nil
+}
+
+func getSingleImage(group, album, res, image, format string) (string, error) {
+	d, err := parseRes(res, format)
 	if err != nil {
 		return "", err
 	}
-	imgSize := 0
-	for _, sz := range sizes {
-		if sz == size {
-			imgSize = sz
-			break
-		}
+	albumPath, _, err := resolveImage(group, album, image)
+	if err != nil {
+		return "", err
 	}
-	if imgSize <= 0 {
-		return "", badImageSize
+	return cacheImage(albumPath, image, d)
+}
+
+// cachePathOf returns the cache file name of an image derivative:
+// imgA.jpg@200-key-size.jpg, imgA.jpg@sq200-key-size.jpg, or
+// imgA.jpg@200-key-size.jpg.webp for other formats. The key identifies the
+// resample settings of the size and size is the byte size of the source, so
+// a source rewritten within the same second does not match old cache files.
+// Sources browsers can not show are cached as JPEG: imgC.heic@200-key-size.jpg.
+// The full source name keeps imgD.cr2 and imgD.jpg apart.
+func cachePathOf(albumPath, image string, srcSize int64, d derivative) string {
+	cacheImageName := image + "@" + d.res() + "-" + d.key() + "-" + strconv.FormatInt(srcSize, 10) + webExt(image)
+	if d.format != formatSource {
+		cacheImageName += "." + d.format
 	}
+	return filepath.Join(albumPath, cacheDir, cacheImageName)
+}
 
-	ext := filepath.Ext(image)
-	cacheImageName := image[:len(image)-len(ext)] + "@" + res + ext
-	err = os.MkdirAll(filepath.Join(root, groupsFolder, group, album, cacheDir), 0777)
+// cacheValid reports if the cache file was built from the current source.
+// Cache files carry the modification time of their source, compared to the
+// second as some file systems store less. The source size is part of the
+// cache file name.
+func cacheValid(src os.FileInfo, cachePath string) bool {
+	fi, err := os.Stat(cachePath)
 	if err != nil {
-		return "", err
+		return false
 	}
-	cachePath := filepath.Join(root, groupsFolder, group, album, cacheDir, cacheImageName)
-	cacheImage, err := os.Open(cachePath)
+	return fi.ModTime().Unix() == src.ModTime().Unix()
+}
+
+// cacheImage returns the cache file of the image derivative, resizing the
+// image first if it is not cached or the source changed. Concurrent calls
+// for the same cache file share one resize.
+func cacheImage(albumPath, image string, d derivative) (string, error) {
+	fullImagePath := filepath.Join(albumPath, image)
+	src, err := os.Stat(fullImagePath)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return "", err
-		}
-		// Resize image, open cache image.
-		fullImagePath := filepath.Join(root, groupsFolder, group, album, image)
-		f, err := os.Open(fullImagePath)
-		if err != nil {
-			return "", err
-		}
-		meta, err := exif.Decode(f)
-		f.Close()
-		rotateImage := 0
-		if err == nil {
-			tag, err := meta.Get(exif.Orientation)
-			if err == nil && tag.Count > 0 {
-				rotateImage = int(tag.Int(0))
-			}
+		return "", err
+	}
+	cachePath := cachePathOf(albumPath, image, src.Size(), d)
+	if cacheValid(src, cachePath) {
+		return cachePath, nil
+	}
+	_, err, _ = cacheFlight.Do(cachePath, func() (interface{}, error) {
+		resizeSlots <- struct{}{}
+		defer func() { <-resizeSlots }()
+
+		// Another call may have finished while this one waited.
+		if cacheValid(src, cachePath) {
+			return nil, nil
 		}
-		fullImage, err := imaging.Open(fullImagePath)
+		err := os.MkdirAll(filepath.Dir(cachePath), 0777)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
+		return nil, resizeImage(fullImagePath, cachePath, d, src.ModTime())
+	})
+	if err != nil {
+		return "", err
+	}
+	return cachePath, nil
+}
 
-		switch rotateImage {
-		case 0:
-			// No rotation.
-		case 1:
-			// No rotation.
-		case 2:
-			// Left-right flip.
-			fullImage = imaging.FlipV(fullImage)
-		case 3:
-			// Rot 180 deg.
-			fullImage = imaging.Rotate180(fullImage)
-		case 4:
-			// Top-bottom flip.
-			fullImage = imaging.FlipH(fullImage)
-		case 5:
-			// Rot 90 deg, left-right flip.
-			fullImage = imaging.Rotate90(fullImage)
-			fullImage = imaging.FlipV(fullImage)
-		case 6:
-			// Rot 270 deg.
-			fullImage = imaging.Rotate270(fullImage)
-		case 7:
-			// Rot 90 deg, top-bottom flip.
-			fullImage = imaging.Rotate90(fullImage)
-			fullImage = imaging.FlipH(fullImage)
-		case 8:
-			// Rot 90 deg.
-			fullImage = imaging.Rotate90(fullImage)
-		default:
-			log.Warning("Unknown exif orientation value: %d", rotateImage)
+// resizeImage fits or crops the image, rotated by its EXIF orientation, to
+// the derivative size and saves it to cachePath with the modification time
+// of the source.
+func resizeImage(fullImagePath, cachePath string, d derivative, modTime time.Time) error {
+	f, err := os.Open(fullImagePath)
+	if err != nil {
+		return err
+	}
+	meta, err := exif.Decode(f)
+	f.Close()
+	rotateImage := 0
+	if err == nil {
+		tag, err := meta.Get(exif.Orientation)
+		if err == nil && tag.Count > 0 {
+			rotateImage = int(tag.Int(0))
 		}
-		resized := imaging.Fit(fullImage, imgSize, imgSize, imaging.Linear)
-		err = imaging.Save(resized, cachePath)
+	}
+	fullImage, err := decodeSource(fullImagePath)
+	if err != nil {
+		return err
+	}
+
+	switch rotateImage {
+	case 0:
+		// No rotation.
+	case 1:
+		// No rotation.
+	case 2:
+		// Left-right flip.
+		fullImage = imaging.FlipV(fullImage)
+	case 3:
+		// Rot 180 deg.
+		fullImage = imaging.Rotate180(fullImage)
+	case 4:
+		// Top-bottom flip.
+		fullImage = imaging.FlipH(fullImage)
+	case 5:
+		// Rot 90 deg, left-right flip.
+		fullImage = imaging.Rotate90(fullImage)
+		fullImage = imaging.FlipV(fullImage)
+	case 6:
+		// Rot 270 deg.
+		fullImage = imaging.Rotate270(fullImage)
+	case 7:
+		// Rot 90 deg, top-bottom flip.
+		fullImage = imaging.Rotate90(fullImage)
+		fullImage = imaging.FlipH(fullImage)
+	case 8:
+		// Rot 90 deg.
+		fullImage = imaging.Rotate90(fullImage)
+	default:
+		log.Warning("Unknown exif orientation value: %d", rotateImage)
+	}
+	rs := resampling.forSize(d.size)
+	filter := resampleFilters[rs.Filter]
+	var resized *image.NRGBA
+	if d.square {
+		resized = cropSquare(fullImage, d.size, filter)
+	} else {
+		resized = imaging.Fit(fullImage, d.size, d.size, filter)
+	}
+	if rs.Sharpen > 0 {
+		resized = imaging.Sharpen(resized, rs.Sharpen)
+	}
+	return saveCached(resized, cachePath, d.format, webExt(fullImagePath), rs, modTime)
+}
+
+// saveCached writes the image to a temporary file and renames it into place
+// so a partial cache file is never served.
+func saveCached(img image.Image, cachePath, format, sourceExt string, rs resample, modTime time.Time) error {
+	return writeAtomic(cachePath, 0644, func(f *os.File) error {
+		err := encodeImage(f, img, format, sourceExt, rs)
 		if err != nil {
-			return "", err
+			return err
 		}
-	}
-	cacheImage.Close()
-	return cachePath, nil
+		return os.Chtimes(f.Name(), modTime, modTime)
+	})
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRes(t *testing.T) {
+	list := []struct {
+		res string
+		d   derivative
+		ok  bool
+	}{
+		{"200", derivative{size: 200, format: formatWebP}, true},
+		{"1280", derivative{size: 1280, format: formatWebP}, true},
+		{"sq200", derivative{size: 200, square: true, format: formatWebP}, true},
+		{"sq1280", derivative{}, false},
+		{"300", derivative{}, false},
+		{"sq", derivative{}, false},
+		{"", derivative{}, false},
+		{"-200", derivative{}, false},
+		{"x200", derivative{}, false},
+	}
+	for _, item := range list {
+		d, err := parseRes(item.res, formatWebP)
+		if (err == nil) != item.ok {
+			t.Errorf("parseRes(%q) error = %v, want ok %t", item.res, err, item.ok)
+			continue
+		}
+		if item.ok && d != item.d {
+			t.Errorf("parseRes(%q) = %+v, want %+v", item.res, d, item.d)
+		}
+	}
+}
+
+func TestCachePathOf(t *testing.T) {
+	key := func(size int) string {
+		return resampling.forSize(size).key() + "-1234"
+	}
+	list := []struct {
+		image string
+		d     derivative
+		name  string
+	}{
+		{"a.jpg", derivative{size: 200}, "a.jpg@200-" + key(200) + ".jpg"},
+		{"a.jpg", derivative{size: 200, format: formatWebP}, "a.jpg@200-" + key(200) + ".jpg.webp"},
+		{"a.b.png", derivative{size: 1280}, "a.b.png@1280-" + key(1280) + ".png"},
+		{"a.jpg", derivative{size: 200, square: true}, "a.jpg@sq200-" + squareCrop + "-" + key(200) + ".jpg"},
+		{"a.heic", derivative{size: 200}, "a.heic@200-" + key(200) + ".jpg"},
+		{"a.CR2", derivative{size: 200}, "a.CR2@200-" + key(200) + ".jpg"},
+		{"a.mp4", derivative{size: 200}, "a.mp4@200-" + key(200) + ".jpg"},
+	}
+	for _, item := range list {
+		got := cachePathOf("album", item.image, 1234, item.d)
+		want := filepath.Join("album", cacheDir, item.name)
+		if got != want {
+			t.Errorf("cachePathOf(%q, %+v) = %q, want %q", item.image, item.d, got, want)
+		}
+	}
+	// A rewritten source of another size does not use the old cache files.
+	d := derivative{size: 200}
+	if cachePathOf("album", "a.jpg", 1234, d) == cachePathOf("album", "a.jpg", 1235, d) {
+		t.Error("cachePathOf ignores the source size")
+	}
+}
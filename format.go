@@ -0,0 +1,101 @@
+package main
+
+import (
+	"image"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/jpegli"
+	"github.com/gen2brain/webp"
+)
+
+// Cached image formats. The source format is kept for browsers that do not
+// accept any other.
+const (
+	formatSource = ""
+	formatWebP   = "webp"
+	formatAVIF   = "avif"
+)
+
+var formatTypes = map[string]string{
+	formatWebP: "image/webp",
+	formatAVIF: "image/avif",
+}
+
+// Smallest files first.
+var formatPreference = []string{formatAVIF, formatWebP}
+
+// cachedFormats lists every format built for each image size.
+func cachedFormats() []string {
+	return append([]string{formatSource}, formats...)
+}
+
+// negotiateFormat picks the preferred enabled format the Accept header allows.
+func negotiateFormat(accept string) string {
+	for _, format := range formatPreference {
+		if formats.contains(format) && acceptsType(accept, formatTypes[format]) {
+			return format
+		}
+	}
+	return formatSource
+}
+
+// acceptsType reports if the Accept header lists the media type without
+// a zero quality.
+func acceptsType(accept, mediaType string) bool {
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		if strings.TrimSpace(params[0]) != mediaType {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				if err == nil && q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// encodeImage writes img in the format, or for formatSource in the imaging
+// format of the extension. Quality applies to JPEG and WebP, AVIF uses its
+// own default as its scale differs. Progressive JPEGs are written by jpegli
+// as the standard library only writes baseline JPEGs.
+func encodeImage(w io.Writer, img image.Image, format, ext string, rs resample) error {
+	switch format {
+	case formatWebP:
+		return webp.Encode(w, img, webp.Options{Quality: rs.Quality, Method: webp.DefaultMethod})
+	case formatAVIF:
+		return avif.Encode(w, img, avif.Options{
+			Quality:           avif.DefaultQuality,
+			QualityAlpha:      avif.DefaultQuality,
+			Speed:             avif.DefaultSpeed,
+			ChromaSubsampling: image.YCbCrSubsampleRatio420,
+		})
+	}
+	f, err := imaging.FormatFromExtension(ext)
+	if err != nil {
+		return err
+	}
+	if f == imaging.JPEG && rs.Progressive {
+		// Standard tables keep quality on the same scale as baseline JPEGs.
+		return jpegli.Encode(w, img, &jpegli.EncodingOptions{
+			Quality:              rs.Quality,
+			ChromaSubsampling:    image.YCbCrSubsampleRatio420,
+			ProgressiveLevel:     2,
+			OptimizeCoding:       true,
+			AdaptiveQuantization: true,
+			StandardQuantTables:  true,
+			DCTMethod:            jpegli.DefaultDCTMethod,
+		})
+	}
+	return imaging.Encode(w, img, f, imaging.JPEGQuality(rs.Quality))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestAcceptsType(t *testing.T) {
+	list := []struct {
+		accept string
+		ok     bool
+	}{
+		{"image/webp", true},
+		{"image/avif,image/webp,*/*", true},
+		{"image/png, image/webp;q=0.8", true},
+		{"image/webp;q=0", false},
+		{"image/webp; q=0.0", false},
+		{"image/webp;q=bad", true},
+		{"image/webpx", false},
+		{"image/*", false},
+		{"", false},
+	}
+	for _, item := range list {
+		if got := acceptsType(item.accept, "image/webp"); got != item.ok {
+			t.Errorf("acceptsType(%q) = %t, want %t", item.accept, got, item.ok)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	defer func(old stringList) { formats = old }(formats)
+
+	list := []struct {
+		formats stringList
+		accept  string
+		format  string
+	}{
+		{stringList{formatWebP}, "image/avif,image/webp", formatWebP},
+		{stringList{formatWebP, formatAVIF}, "image/avif,image/webp", formatAVIF},
+		{stringList{formatWebP, formatAVIF}, "image/webp", formatWebP},
+		{stringList{formatWebP, formatAVIF}, "image/avif;q=0,image/webp", formatWebP},
+		{stringList{formatAVIF}, "image/webp", formatSource},
+		{stringList{}, "image/avif,image/webp", formatSource},
+		{stringList{formatWebP}, "", formatSource},
+	}
+	for _, item := range list {
+		formats = item.formats
+		if got := negotiateFormat(item.accept); got != item.format {
+			t.Errorf("negotiateFormat(%q) with %v = %q, want %q", item.accept, item.formats, got, item.format)
+		}
+	}
+}
+
+// Progressive JPEGs start with a progressive frame header, SOF2.
+func TestEncodeProgressive(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for _, progressive := range []bool{false, true} {
+		var buf bytes.Buffer
+		err := encodeImage(&buf, img, formatSource, ".jpg", resample{Quality: 85, Progressive: progressive})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.Contains(buf.Bytes(), []byte{0xFF, 0xC2}); got != progressive {
+			t.Errorf("Progressive %t: SOF2 written = %t", progressive, got)
+		}
+	}
+	if (resample{Quality: 85}).key() == (resample{Quality: 85, Progressive: true}).key() {
+		t.Error("Progressive setting not part of the cache key")
+	}
+}
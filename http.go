@@ -1,10 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"html/template"
 	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
@@ -16,11 +21,18 @@ func setupAuthRouter() *httprouter.Router {
 	router.PanicHandler = httpPanic
 
 	router.GET("/u/", rootHandler)
-	router.GET("/u/:group/", checkGroup(groupHandler))
-	router.GET("/u/:group/:album/", checkGroup(albumHandler))
-	router.GET("/u/:group/:album/:res/:image", checkGroup(imageHandler))
+	// Albums nest to any depth so the rest of the path is routed by groupPathHandler.
+	router.GET("/u/:group/*path", checkGroup(groupPathHandler))
 
 	router.GET("/api/logout", logout)
+	router.POST("/api/upload/:group/*album", checkGroup(checkRole(roleUploader, uploadHandler)))
+	router.POST("/api/album/:group/*album", checkGroup(checkRole(roleEditor, albumActionHandler)))
+
+	router.GET("/admin/", checkAdmin(adminHandler))
+	router.POST("/admin/api/add", adminEdit(adminAddUser))
+	router.POST("/admin/api/groups", adminEdit(adminSetGroups))
+	router.POST("/admin/api/disable", adminEdit(adminSetDisabled))
+	router.POST("/admin/api/logout", checkAdmin(adminLogout))
 
 	router.ServeFiles("/lib/*filepath", http.Dir(filepath.Join(root, "lib")))
 
@@ -95,11 +107,29 @@ func checkGroup(h httprouter.Handle) httprouter.Handle {
 	}
 }
 
+// sameOrigin reports if a form post came from this site. Every form and
+// fetch is sent from the site's own pages, so requests without Origin or
+// Referer headers are refused.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		origin = r.Header.Get("Referer")
+	}
+	if len(origin) == 0 {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
+
 // /
 func rootHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
 	// List authorized groups available from context.
 	c := w.(*Context)
-	if len(c.Groups) == 1 {
+	if len(c.Groups) == 1 && !c.Admin {
 		http.Redirect(w, r, path.Join("/u/", c.Groups[0]), 302)
 		return
 	}
@@ -118,32 +148,152 @@ func rootHandler(w http.ResponseWriter, r *http.Request, _ map[string]string) {
 	}
 }
 
+// groupPathHandler routes the path after the group:
+//
+//	/                      the group
+//	/album/sub/            an album at any depth
+//	/album/sub/res/image   an image or video of an album
+//	/album/sub/orig/image  the original file to download
+func groupPathHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	c := w.(*Context)
+	p := vars["path"]
+	if p == "/" {
+		groupHandler(w, r, vars)
+		return
+	}
+	// Hidden albums and their images are only shown to editors.
+	visible := func(album string) bool {
+		return c.HasRole(vars["group"], roleEditor) || !albumHidden(vars["group"], album)
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if strings.HasSuffix(p, "/") {
+		vars["album"] = strings.Join(parts, "/")
+		if !validAlbum(vars["album"]) || !visible(vars["album"]) {
+			notFoundAuth(w, r)
+			return
+		}
+		albumHandler(w, r, vars)
+		return
+	}
+	if len(parts) < 3 {
+		// An album without the trailing slash.
+		http.Redirect(w, r, r.URL.Path+"/", 302)
+		return
+	}
+	// A sub-album without the trailing slash. Image names are never taken
+	// for albums so image URLs do not need the extra lookup.
+	if album := strings.Join(parts, "/"); !isImageName(parts[len(parts)-1]) {
+		if _, err := resolveAlbum(vars["group"], album); err == nil && visible(album) {
+			http.Redirect(w, r, r.URL.Path+"/", 302)
+			return
+		}
+	}
+	vars["album"] = strings.Join(parts[:len(parts)-2], "/")
+	vars["res"] = parts[len(parts)-2]
+	vars["image"] = parts[len(parts)-1]
+	if !validAlbum(vars["album"]) || !visible(vars["album"]) {
+		notFoundAuth(w, r)
+		return
+	}
+	imageHandler(w, r, vars)
+}
+
+// albumCard is an album on the group or parent album page.
+type albumCard struct {
+	Name string
+	// URL and CoverURL are relative to the page listing the album.
+	URL, CoverURL string
+	// Title comes from the album stats. Hidden albums, or albums inside
+	// one, are only listed for editors.
+	albumStats
+}
+
+func newAlbumCard(group, parent, name string, parentHidden bool) albumCard {
+	album := path.Join(parent, name)
+	card := albumCard{
+		Name: name,
+		URL:  (&url.URL{Path: name + "/"}).String(),
+	}
+	stats, err := getAlbumStats(group, album)
+	if err != nil {
+		log.Warning("Failed to read album %s/%s: %v", group, album, err)
+		card.Hidden = parentHidden
+		return card
+	}
+	card.albumStats = stats
+	card.Hidden = stats.Hidden || parentHidden
+	if len(stats.Cover) != 0 {
+		card.CoverURL = (&url.URL{Path: path.Join(name, thumbRes(), stats.Cover)}).String()
+	}
+	return card
+}
+
+// newAlbumCards returns the cards of the albums, leaving out hidden albums
+// unless showHidden is set.
+func newAlbumCards(group, parent string, names []string, showHidden bool) []albumCard {
+	parentHidden := len(parent) != 0 && albumHidden(group, parent)
+	cards := make([]albumCard, 0, len(names))
+	for _, name := range names {
+		card := newAlbumCard(group, parent, name, parentHidden)
+		if card.Hidden && !showHidden {
+			continue
+		}
+		cards = append(cards, card)
+	}
+	return cards
+}
+
+// crumb links to a parent of the current page.
+type crumb struct {
+	Name, URL string
+}
+
+// albumCrumbs lists the group and every parent album of album.
+func albumCrumbs(group, album string) []crumb {
+	list := []crumb{{Name: group, URL: albumURL(group, "")}}
+	parts := strings.Split(album, "/")
+	for i := range parts[:len(parts)-1] {
+		list = append(list, crumb{Name: parts[i], URL: albumURL(group, strings.Join(parts[:i+1], "/"))})
+	}
+	return list
+}
+
 // /:group
 func groupHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) {
 	// List albums in groups (list folders in group that don't start with a ".").
 	// Fetch list of folders in group.
 	group := vars["group"]
 	c := w.(*Context)
+	_, err := resolveGroup(group)
+	if err != nil {
+		notFoundAuth(w, r)
+		return
+	}
 	albums, err := getAlbums(group)
 	if err != nil {
 		log.Error("Error getting albums: %v", err)
 		notFoundAuth(w, r)
 		return
 	}
+	cards := newAlbumCards(group, "", albums, c.HasRole(group, roleEditor))
 	err = allTemplates.ExecuteTemplate(w, "group.template", struct {
-		Rand     int64
-		SiteName string
-		Group    string
-		Albums   []string
+		Rand      int64
+		SiteName  string
+		Group     string
+		Albums    []albumCard
+		ThumbSize int
 
 		ManyGroup bool
+		CanEdit   bool
 	}{
-		Rand:     rand.Int63(),
-		SiteName: siteName,
-		Group:    group,
-		Albums:   albums,
+		Rand:      rand.Int63(),
+		SiteName:  siteName,
+		Group:     group,
+		Albums:    cards,
+		ThumbSize: thumbSize,
 
 		ManyGroup: (len(c.Groups) != 1),
+		CanEdit:   c.HasRole(group, roleEditor),
 	})
 	if err != nil {
 		log.Error("Error running template: %v", err)
@@ -151,37 +301,132 @@ func groupHandler(w http.ResponseWriter, r *http.Request, vars map[string]string
 	}
 }
 
-// /:group/:album
+type albumImage struct {
+	Name    string
+	Video   bool
+	Caption string
+	Info    []infoField
+	// Srcset lists every thumbnail size of the image relative to the
+	// album page.
+	Srcset template.Srcset
+	// Raw is the RAW file shot with a JPEG, downloaded from its view.
+	Raw string
+}
+
+// thumbRes is the URL size of album thumbnails.
+func thumbRes() string {
+	return derivative{size: thumbSize, square: squareThumbs}.res()
+}
+
+func newAlbumImage(name, caption string, info []infoField) albumImage {
+	// Commas separate srcset entries.
+	escaped := strings.Replace((&url.URL{Path: name}).String(), ",", "%2C", -1)
+	thumbSizes := sizes
+	if squareThumbs {
+		thumbSizes = squareSizes
+	}
+	list := make([]string, len(thumbSizes))
+	for i, size := range thumbSizes {
+		d := derivative{size: size, square: squareThumbs}
+		list[i] = fmt.Sprintf("%s/%s %dw", d.res(), escaped, size)
+	}
+	return albumImage{
+		Name:    name,
+		Video:   isVideoName(name),
+		Caption: caption,
+		Info:    info,
+		Srcset:  template.Srcset(strings.Join(list, ", ")),
+	}
+}
+
+// /:group/:album/, where album may be a path of sub-albums.
 func albumHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) {
 	// List images from files in directory. Will reference images (below).
+	c := w.(*Context)
+	group := vars["group"]
 	album := vars["album"]
-	desc, images, err := getImages(vars["group"], album)
+	albumPath, err := resolveAlbum(group, album)
+	if err != nil {
+		notFoundAuth(w, r)
+		return
+	}
+	desc, names, err := getImages(albumPath)
 	if err != nil {
 		log.Error("Error getting images: %v", err)
 		notFoundAuth(w, r)
 		return
 	}
-	desc = strings.Trim(desc, " \n\r\t")
-	titleAt := strings.Index(desc, "\n\n")
-	title := ""
-	if titleAt > 0 {
-		title = desc[:titleAt]
-		desc = desc[titleAt+2:]
+	canEdit := c.HasRole(group, roleEditor)
+	showGPS := canEdit || !hideGPS.contains(group)
+	info := albumPhotoInfo(albumPath, names)
+	captions := readCaptions(albumPath, names, info)
+	download := canDownload(c, group)
+	images := make([]albumImage, len(names))
+	for i, name := range names {
+		images[i] = newAlbumImage(name, captions[name], info[name].fields(showGPS))
+		if download {
+			images[i].Raw = pairedRaw(albumPath, name)
+		}
+	}
+	children, err := subAlbums(group, album)
+	if err != nil {
+		log.Error("Error getting sub-albums: %v", err)
+	}
+	// Editors may move images to any album of the group.
+	var albums []string
+	if canEdit {
+		albums, err = allAlbums(group)
+		if err != nil {
+			log.Error("Error getting albums: %v", err)
+		}
 	}
-
 	err = allTemplates.ExecuteTemplate(w, "album.template", struct {
-		Rand        int64
-		SiteName    string
-		Album       string
-		Title, Desc string
-		Images      []string
+		Rand     int64
+		SiteName string
+		Group    string
+		Album    string
+		Name     string
+		Crumbs   []crumb
+		Desc     albumDesc
+		Images   []albumImage
+		Children []albumCard
+		Albums   []string
+		Sort     string
+		// Hidden is set if the album or a parent is hidden, HiddenSelf
+		// only for the album.
+		Hidden, HiddenSelf bool
+
+		Sizes     []int
+		ThumbSize int
+		ThumbRes  string
+		ViewSize  int
+
+		CanUpload   bool
+		CanEdit     bool
+		CanDownload bool
 	}{
-		Rand:     rand.Int63(),
-		SiteName: siteName,
-		Album:    album,
-		Images:   images,
-		Title:    title,
-		Desc:     desc,
+		Rand:       rand.Int63(),
+		SiteName:   siteName,
+		Group:      group,
+		Album:      album,
+		Name:       path.Base(album),
+		Crumbs:     albumCrumbs(group, album),
+		Images:     images,
+		Children:   newAlbumCards(group, album, children, canEdit),
+		Desc:       parseDescription(desc),
+		Albums:     albums,
+		Sort:       readAlbumSort(albumPath).Mode,
+		Hidden:     albumHidden(group, album),
+		HiddenSelf: hiddenFolder(albumPath),
+
+		Sizes:     []int(sizes),
+		ThumbSize: thumbSize,
+		ThumbRes:  thumbRes(),
+		ViewSize:  viewSize,
+
+		CanUpload:   c.HasRole(group, roleUploader),
+		CanEdit:     canEdit,
+		CanDownload: download,
 	})
 	if err != nil {
 		log.Error("Error running template: %v", err)
@@ -189,7 +434,7 @@ func albumHandler(w http.ResponseWriter, r *http.Request, vars map[string]string
 	}
 }
 
-// /:group/:album/:res/:image
+// /:group/:album/:res/:image, where album may be a path of sub-albums.
 func imageHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) {
 	// Serve image from Group/Album/img, cache in Group/Album/.cache/img@res.
 	var (
@@ -198,11 +443,92 @@ func imageHandler(w http.ResponseWriter, r *http.Request, vars map[string]string
 		res   = vars["res"]
 		image = vars["image"]
 	)
-	filename, err := getSingleImage(group, album, res, image)
+	switch res {
+	case videoRes:
+		videoHandler(w, r, group, album, image)
+		return
+	case origRes:
+		originalHandler(w, r, group, album, image)
+		return
+	}
+	format := negotiateFormat(r.Header.Get("Accept"))
+	filename, err := getSingleImage(group, album, res, image, format)
+	if err == errNoFFmpeg {
+		// Without ffmpeg videos show a placeholder, not a broken image.
+		http.ServeFile(w, r, filepath.Join(root, "lib", videoPlaceholder))
+		return
+	}
 	if err != nil {
 		log.Error("Error getting images: %v", err)
 		notFoundAuth(w, r)
 		return
 	}
+	w.Header().Set("Vary", "Accept")
+	if format != formatSource {
+		w.Header().Set("Content-Type", formatTypes[format])
+	}
+	http.ServeFile(w, r, filename)
+}
+
+// videoPlaceholder in lib is the thumbnail of videos without a poster frame.
+const videoPlaceholder = "video.svg"
+
+// /:group/:album/video/:image
+func videoHandler(w http.ResponseWriter, r *http.Request, group, album, video string) {
+	_, filename, err := resolveImage(group, album, video)
+	if err != nil || !isVideoName(video) {
+		notFoundAuth(w, r)
+		return
+	}
+	// ServeFile answers range requests so players can seek.
+	w.Header().Set("Content-Type", videoTypes[strings.ToLower(filepath.Ext(video))])
+	http.ServeFile(w, r, filename)
+}
+
+// origRes is the URL size of original files.
+const origRes = "orig"
+
+// canDownload reports if the user may download original files of the group.
+func canDownload(c *Context, group string) bool {
+	if c.HasRole(group, roleEditor) {
+		return true
+	}
+	// Originals carry the GPS coordinates hidden from other viewers.
+	if hideGPS.contains(group) {
+		return false
+	}
+	return downloadGroups.contains(group) || c.HasRole(group, roleDownloader)
+}
+
+// hiddenGPSDownloads lists the hideGPS groups given the download role, where
+// it has no effect as only editors download their originals.
+func hiddenGPSDownloads(roles map[string][]string) []string {
+	var groups []string
+	for group, list := range roles {
+		for _, role := range list {
+			if role == roleDownloader && hideGPS.contains(group) {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// /:group/:album/orig/:image
+func originalHandler(w http.ResponseWriter, r *http.Request, group, album, image string) {
+	c := w.(*Context)
+	if !canDownload(c, group) {
+		notFoundAuth(w, r)
+		return
+	}
+	_, filename, err := resolveImage(group, album, image)
+	if err != nil {
+		notFoundAuth(w, r)
+		return
+	}
+	log.Info("User %s downloaded %s/%s/%s.", c.Username, group, album, image)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": image}))
 	http.ServeFile(w, r, filename)
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestGroupPathRedirect(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+
+	for _, name := range []string{"a/b/c", "a/b/h"} {
+		err := os.MkdirAll(filepath.Join(dir, "groups", "g", filepath.FromSlash(name)), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "groups", "g", "a", "b", "h", hiddenFile), nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viewer := &Context{Groups: []string{"g"}}
+	editor := &Context{Groups: []string{"g"}, Roles: map[string][]string{"g": {roleEditor}}}
+	list := []struct {
+		c        *Context
+		path     string
+		location string
+	}{
+		{viewer, "/a", "/u/g/a/"},
+		{viewer, "/a/b", "/u/g/a/b/"},
+		{viewer, "/a/b/c", "/u/g/a/b/c/"},
+		{viewer, "/a/b/h", "/u/"},
+		{editor, "/a/b/h", "/u/g/a/b/h/"},
+		{viewer, "/a/b/missing", "/u/"},
+		{viewer, "/a/b/c/../../../x", "/u/"},
+	}
+	for _, item := range list {
+		rec := httptest.NewRecorder()
+		c := *item.c
+		c.ResponseWriter = rec
+		r := httptest.NewRequest("GET", "/u/g"+item.path, nil)
+		groupPathHandler(&c, r, map[string]string{"group": "g", "path": item.path})
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != item.location {
+			t.Errorf("%s: got %d to %q, want redirect to %q", item.path, rec.Code, rec.Header().Get("Location"), item.location)
+		}
+	}
+}
+
+func TestOriginalDownload(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+	defer func(download, hide stringList) {
+		downloadGroups, hideGPS = download, hide
+	}(downloadGroups, hideGPS)
+
+	const quoted = `my "best" photo é.jpg`
+	err := ioutil.WriteFile(filepath.Join(dir, "groups", "g", "a", quoted), []byte("image"), 0666)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "groups", "g", "a", "b", hiddenFile), nil, 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	role := func(role string) *Context {
+		return &Context{Groups: []string{"g"}, Roles: map[string][]string{"g": {role}}}
+	}
+	viewer := &Context{Groups: []string{"g"}}
+	list := []struct {
+		name     string
+		c        *Context
+		download stringList
+		hide     stringList
+		path     string
+		ok       bool
+	}{
+		{"viewer", viewer, nil, nil, "/a/orig/img.jpg", false},
+		{"download group", viewer, stringList{"g"}, nil, "/a/orig/img.jpg", true},
+		{"other download group", viewer, stringList{"other"}, nil, "/a/orig/img.jpg", false},
+		{"download role", role(roleDownloader), nil, nil, "/a/orig/img.jpg", true},
+		{"uploader", role(roleUploader), nil, nil, "/a/orig/img.jpg", false},
+		{"editor", role(roleEditor), nil, nil, "/a/orig/img.jpg", true},
+		{"download group hiding GPS", viewer, stringList{"g"}, stringList{"g"}, "/a/orig/img.jpg", false},
+		{"download role hiding GPS", role(roleDownloader), nil, stringList{"g"}, "/a/orig/img.jpg", false},
+		{"editor hiding GPS", role(roleEditor), nil, stringList{"g"}, "/a/orig/img.jpg", true},
+		{"hidden album", viewer, stringList{"g"}, nil, "/a/b/orig/pic.png", false},
+		{"hidden album editor", role(roleEditor), nil, nil, "/a/b/orig/pic.png", true},
+		{"not listed", viewer, stringList{"g"}, nil, "/a/orig/notes.txt", false},
+		{"link out", viewer, stringList{"g"}, nil, "/a/orig/link.jpg", false},
+		{"quoted name", viewer, stringList{"g"}, nil, "/a/orig/" + quoted, true},
+	}
+	for _, item := range list {
+		downloadGroups, hideGPS = item.download, item.hide
+		rec := httptest.NewRecorder()
+		c := *item.c
+		c.ResponseWriter = rec
+		r := httptest.NewRequest("GET", "/u/g/", nil)
+		groupPathHandler(&c, r, map[string]string{"group": "g", "path": item.path})
+		if !item.ok {
+			if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/u/" {
+				t.Errorf("%s: got %d, want redirect to /u/", item.name, rec.Code)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK || rec.Body.String() != "image" {
+			t.Errorf("%s: got %d %q, want the original", item.name, rec.Code, rec.Body.String())
+			continue
+		}
+		disposition, params, err := mime.ParseMediaType(rec.Header().Get("Content-Disposition"))
+		if err != nil || disposition != "attachment" || params["filename"] != path.Base(item.path) {
+			t.Errorf("%s: Content-Disposition %q, want attachment of %q", item.name, rec.Header().Get("Content-Disposition"), path.Base(item.path))
+		}
+	}
+}
+
+// Videos are only streamed if listed in their album.
+func TestVideoHandler(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+
+	albumPath := filepath.Join(dir, "groups", "g", "a")
+	for _, name := range []string{"clip.mp4", ".clip.mp4"} {
+		err := ioutil.WriteFile(filepath.Join(albumPath, name), []byte("video"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink(filepath.Join(dir, "secret.jpg"), filepath.Join(albumPath, "link.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []struct {
+		video string
+		ok    bool
+	}{
+		{"clip.mp4", true},
+		{".clip.mp4", false},
+		{"link.mp4", false},
+		{"img.jpg", false},
+		{"notes.txt", false},
+		{"missing.mp4", false},
+	}
+	for _, item := range list {
+		rec := httptest.NewRecorder()
+		c := &Context{ResponseWriter: rec, Groups: []string{"g"}}
+		r := httptest.NewRequest("GET", "/u/g/a/video/"+item.video, nil)
+		groupPathHandler(c, r, map[string]string{"group": "g", "path": "/a/video/" + item.video})
+		ok := rec.Code == http.StatusOK && rec.Body.String() == "video"
+		if ok != item.ok {
+			t.Errorf("%s: got %d %q, want served %t", item.video, rec.Code, rec.Body.String(), item.ok)
+		}
+		if ok && rec.Header().Get("Content-Type") != "video/mp4" {
+			t.Errorf("%s: Content-Type %q, want video/mp4", item.video, rec.Header().Get("Content-Type"))
+		}
+	}
+}
+
+// Without ffmpeg video thumbnails are a placeholder, not a redirect.
+func TestVideoPlaceholder(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+	oldFFmpeg, oldSlots := ffmpeg, resizeSlots
+	ffmpeg, resizeSlots = "", make(chan struct{}, 1)
+	defer func() { ffmpeg, resizeSlots = oldFFmpeg, oldSlots }()
+
+	placeholder := filepath.Join(dir, "lib", videoPlaceholder)
+	err := os.MkdirAll(filepath.Dir(placeholder), 0777)
+	if err == nil {
+		err = ioutil.WriteFile(placeholder, []byte("<svg/>"), 0666)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "groups", "g", "a", "clip.mp4"), []byte("video"), 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []struct {
+		video string
+		code  int
+	}{
+		{"clip.mp4", http.StatusOK},
+		{"missing.mp4", http.StatusFound},
+	}
+	for _, item := range list {
+		rec := httptest.NewRecorder()
+		c := &Context{ResponseWriter: rec, Groups: []string{"g"}}
+		r := httptest.NewRequest("GET", "/u/g/a/200/"+item.video, nil)
+		groupPathHandler(c, r, map[string]string{"group": "g", "path": "/a/200/" + item.video})
+		if rec.Code != item.code {
+			t.Errorf("%s: got %d, want %d", item.video, rec.Code, item.code)
+		}
+		if item.code == http.StatusOK && rec.Body.String() != "<svg/>" {
+			t.Errorf("%s: got %q, want the placeholder", item.video, rec.Body.String())
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	list := []struct {
+		origin, referer string
+		ok              bool
+	}{
+		{"https://example.com", "", true},
+		{"", "https://example.com/u/g/a/", true},
+		{"https://example.com", "https://other.com/", true},
+		{"https://other.com", "https://example.com/u/", false},
+		{"", "https://other.com/", false},
+		{"null", "", false},
+		{"", "", false},
+	}
+	for _, item := range list {
+		r := httptest.NewRequest("POST", "https://example.com/api/upload/g/a", nil)
+		if len(item.origin) != 0 {
+			r.Header.Set("Origin", item.origin)
+		}
+		if len(item.referer) != 0 {
+			r.Header.Set("Referer", item.referer)
+		}
+		if got := sameOrigin(r); got != item.ok {
+			t.Errorf("Origin %q Referer %q: got %t, want %t", item.origin, item.referer, got, item.ok)
+		}
+	}
+}
@@ -2,17 +2,30 @@
 /*
 URL Root:
 	/
-		users.txt < username:password@groupA,groupB <newline> username2:password@groupB
+		photosite.json < optional settings, keys are the command line flag names
+		users.txt < username:password@groupA,groupB <newline> username2:password@groupB,admin
+			a leading "!" disables a user: !username:password@groupA
+			roles follow a group name: username:password@groupA+uploader
+				uploader adds images, editor manages albums, download gets originals
+			plain text passwords are replaced with bcrypt hashes when loaded, other lines are kept as written
 		groupA/
 			album1/
 				.cache/
-					imgA@200.jpg
-					imgA@640.jpg
-					imgB@200.jpg
-					imgB@640.jpg
-				text.txt < title <newline><newline> body
-				imgA.jpg
+					imgA.jpg@200-key-size.jpg < cached sizes, named after the full source name and its byte size
+					imgA.jpg@1280-key-size.jpg.webp
+					imgB.jpg@200-key-size.jpg
+					imgB.jpg@1280-key-size.jpg.webp
+					clipA.mp4@poster-size.png < frame extracted once by ffmpeg, the sizes of clipA.mp4 are made from it
+					info.json < EXIF metadata of each image, refreshed when an image changes
+				Description.txt < optional ---, date/cover/sort/hidden front matter, --- <newline> title <newline><newline> Markdown body
+				.sort < image order: date, name, mtime or manual <newline> offset Camera Model: -1h30m
+				.order < image names in manual order, one per line
+				.cover < cover image name shown on the group page, unless set in Description.txt
+				imgA.jpg < downloaded unchanged from orig/imgA.jpg by editors, members of downloadGroups and the download role, only editors if hideGPS
 				imgB.jpg
+				imgB.cr2 < a RAW file with a same named JPEG is not listed, it downloads from orig/imgB.cr2 next to imgB.jpg
+				clipA.mp4 < listed with a poster frame made by ffmpeg, or lib/video.svg without it, streamed from video/clipA.mp4
+				day1/ < sub-albums nest to any depth: /u/groupA/album1/day1/
 
 */
 package main
@@ -39,6 +52,9 @@ const (
 	cookieKeyName = "sk"
 	keyByteLength = 2048 / 8
 
+	// Members of adminGroup may manage users and sessions.
+	adminGroup = "admin"
+
 	groupsFolder    = "groups"
 	usersFileName   = "users.txt"
 	sessionFileName = "sessions.bolt"
@@ -50,8 +66,6 @@ const (
 )
 
 var (
-	sizes = []int{200, 1280}
-
 	allTemplates *template.Template
 
 	sampleUsers = &UserList{
@@ -75,10 +89,22 @@ var (
 	tlsServer *http.Server
 )
 
-// TODO: Load setting from config file.
 // TODO: Add in-line large photo viewer.
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	parseFlags()
+
+	if len(os.Args) > 1 {
+		if run, found := commands[os.Args[1]]; found {
+			log = consoleLogger{}
+			err := run(os.Args[2:])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
 	sc := &srv.Config{
 		Name:            "photosite",
@@ -93,6 +119,28 @@ func main() {
 	sc.Run()
 }
 
+// commands run from the command line instead of the service.
+var commands = map[string]func(args []string) error{
+	"user":  runUserCommand,
+	"cache": runCacheCommand,
+}
+
+// consoleLogger logs to standard error for commands.
+type consoleLogger struct{}
+
+func (consoleLogger) Error(format string, a ...interface{}) error {
+	_, err := fmt.Fprintf(os.Stderr, "Error: "+format+"\n", a...)
+	return err
+}
+func (consoleLogger) Warning(format string, a ...interface{}) error {
+	_, err := fmt.Fprintf(os.Stderr, "Warning: "+format+"\n", a...)
+	return err
+}
+func (consoleLogger) Info(format string, a ...interface{}) error {
+	_, err := fmt.Fprintf(os.Stderr, format+"\n", a...)
+	return err
+}
+
 type redirectToDomain string
 
 func (rt redirectToDomain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -117,6 +165,14 @@ func httpInit(c *srv.Config) error {
 	var err error
 	log = c.Logger()
 
+	err = loadSettings()
+	if err != nil {
+		log.Error("Failed to load settings: %v", err)
+		return err
+	}
+	warnSettings()
+	initCache()
+
 	err = loadTemplates()
 	if err != nil {
 		return err
@@ -184,6 +240,13 @@ func start(c *srv.Config) {
 	var err error
 
 	go startExpire()
+	startCacheWorkers()
+	if watchGroups {
+		err = startWatcher()
+		if err != nil {
+			log.Error("Failed to watch groups: %v", err)
+		}
+	}
 
 	go func() {
 		ticker := time.NewTicker(reloadUserTime)
@@ -198,6 +261,25 @@ func start(c *srv.Config) {
 					log.Error("Failed to load user list: %v", err)
 					continue
 				}
+				changed, err := userList.hashPasswords()
+				if err != nil {
+					log.Error("Failed to hash passwords: %v", err)
+					continue
+				}
+				if changed {
+					// Saving triggers another load of the hashed list.
+					err = saveUsers(filepath.Join(root, usersFileName), userList)
+					if err != nil {
+						log.Error("Failed to save hashed passwords: %v", err)
+					} else {
+						log.Info("Plain text passwords replaced with hashes.")
+					}
+				}
+				for _, u := range userList.Order {
+					if groups := hiddenGPSDownloads(u.Roles); len(groups) != 0 {
+						log.Warning("User %s has the %s role in hideGPS groups %s, only editors download their originals.", u.Username, roleDownloader, strings.Join(groups, ", "))
+					}
+				}
 				auth.Lock()
 				auth.AuthorizedList = userList
 				auth.Unlock()
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Album image orders.
+const (
+	// sortDate orders by EXIF capture time, corrected by camera clock
+	// offsets, then by modification time for images without one.
+	sortDate = "date"
+	// sortName orders by file name, comparing numbers by value.
+	sortName = "name"
+	// sortModTime orders by file modification time.
+	sortModTime = "mtime"
+	// sortManual orders by the album order file, then by modification time.
+	sortManual = "manual"
+)
+
+var sortModes = map[string]bool{sortDate: true, sortName: true, sortModTime: true, sortManual: true}
+
+// Album files read when ordering images.
+const (
+	// sortFile holds the order of the album and camera clock offsets, one
+	// per line: "date" and "offset Canon EOS 5D: -1h30m".
+	sortFile = ".sort"
+	// orderFile lists image names, one per line, for sortManual.
+	orderFile = ".order"
+)
+
+// albumSort is the order of an album and the clock offsets of its cameras.
+type albumSort struct {
+	Mode    string
+	Offsets map[string]time.Duration
+}
+
+// readAlbumSort reads the sort file of the album. Without one, the sort of
+// the description front matter is used, then an order file if present.
+func readAlbumSort(albumPath string) albumSort {
+	as := albumSort{Mode: defaultSort}
+	bb, err := ioutil.ReadFile(filepath.Join(albumPath, sortFile))
+	if err != nil {
+		if desc := readAlbumDesc(albumPath); len(desc.Sort) != 0 && sortModes[desc.Sort] {
+			as.Mode = desc.Sort
+		} else if _, err = os.Stat(filepath.Join(albumPath, orderFile)); err == nil {
+			as.Mode = sortManual
+		}
+		return as
+	}
+	s := bufio.NewScanner(bytes.NewReader(bb))
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		if !strings.HasPrefix(text, "offset ") {
+			if !sortModes[text] {
+				log.Warning("Unknown sort %q on line %d of %s.", text, line, filepath.Join(albumPath, sortFile))
+				continue
+			}
+			as.Mode = text
+			continue
+		}
+		camera, offset, err := parseSortOffset(text)
+		if err != nil {
+			log.Warning("Bad line %d in %s: %v", line, filepath.Join(albumPath, sortFile), err)
+			continue
+		}
+		if as.Offsets == nil {
+			as.Offsets = make(map[string]time.Duration)
+		}
+		as.Offsets[camera] = offset
+	}
+	return as
+}
+
+// parseSortOffset reads "offset <camera>: <duration>".
+func parseSortOffset(text string) (string, time.Duration, error) {
+	text = text[len("offset "):]
+	at := strings.LastIndex(text, ":")
+	if at < 0 {
+		return "", 0, fmt.Errorf("Missing \":\" after camera")
+	}
+	offset, err := time.ParseDuration(strings.TrimSpace(text[at+1:]))
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.TrimSpace(text[:at]), offset, nil
+}
+
+// writeAlbumSort sets the order of an album, keeping any clock offsets
+// and comments.
+func writeAlbumSort(albumPath, mode string) error {
+	lines := []string{mode}
+	bb, err := ioutil.ReadFile(filepath.Join(albumPath, sortFile))
+	if err == nil {
+		for _, line := range strings.Split(string(bb), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "offset ") || strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return writeFileAtomic(filepath.Join(albumPath, sortFile), []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// writeOrderFile saves the manual order of an album and selects it.
+func writeOrderFile(albumPath string, names []string) error {
+	err := writeFileAtomic(filepath.Join(albumPath, orderFile), []byte(strings.Join(names, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	return writeAlbumSort(albumPath, sortManual)
+}
+
+// imageOrder caches the resolved order of an album until a file in it changes.
+type imageOrder struct {
+	key   string
+	names []string
+}
+
+var (
+	imageOrdersLock sync.Mutex
+	imageOrders     = map[string]imageOrder{}
+)
+
+// sortImages returns the image names in album order.
+func sortImages(albumPath string, files []os.FileInfo) []string {
+	key := orderKey(albumPath, files)
+	imageOrdersLock.Lock()
+	cached, found := imageOrders[albumPath]
+	imageOrdersLock.Unlock()
+	if found && cached.key == key {
+		return cached.names
+	}
+
+	sort.Sort(sortFileInfo(files))
+	names := make([]string, len(files))
+	for i, fi := range files {
+		names[i] = fi.Name()
+	}
+	as := readAlbumSort(albumPath)
+	switch as.Mode {
+	case sortDate:
+		sortByDate(albumPath, names, files, as.Offsets)
+	case sortName:
+		sort.SliceStable(names, func(i, j int) bool { return naturalLess(names[i], names[j]) })
+	case sortManual:
+		names = sortByOrderFile(albumPath, names)
+	}
+
+	imageOrdersLock.Lock()
+	imageOrders[albumPath] = imageOrder{key: key, names: names}
+	imageOrdersLock.Unlock()
+	return names
+}
+
+// orderKey identifies the album files and sort settings an order was
+// resolved from.
+func orderKey(albumPath string, files []os.FileInfo) string {
+	var buf bytes.Buffer
+	for _, fi := range files {
+		fmt.Fprintf(&buf, "%s\x00%d\x00", fi.Name(), fi.ModTime().UnixNano())
+	}
+	// The info index gives capture dates once the cache workers fill it.
+	for _, name := range []string{sortFile, orderFile, descriptionFile, filepath.Join(cacheDir, photoInfoFile)} {
+		if fi, err := os.Stat(filepath.Join(albumPath, name)); err == nil {
+			fmt.Fprintf(&buf, "%s\x00%d\x00", name, fi.ModTime().UnixNano())
+		}
+	}
+	return buf.String()
+}
+
+// sortByDate orders names, already in modification time order, by capture
+// time. Images without a capture time use their modification time.
+func sortByDate(albumPath string, names []string, files []os.FileInfo, offsets map[string]time.Duration) {
+	info := albumPhotoInfo(albumPath, names)
+	taken := make(map[string]time.Time, len(files))
+	for _, fi := range files {
+		name := fi.Name()
+		t := info[name].Taken
+		if t.IsZero() {
+			t = fi.ModTime()
+		} else {
+			t = t.Add(offsets[info[name].Camera])
+		}
+		taken[name] = t
+	}
+	sort.SliceStable(names, func(i, j int) bool { return taken[names[i]].Before(taken[names[j]]) })
+}
+
+// sortByOrderFile puts the names listed in the order file first, in that
+// order, followed by the rest in their current order.
+func sortByOrderFile(albumPath string, names []string) []string {
+	bb, err := ioutil.ReadFile(filepath.Join(albumPath, orderFile))
+	if err != nil {
+		return names
+	}
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for _, name := range strings.Split(string(bb), "\n") {
+		name = strings.TrimRight(name, "\r")
+		if present[name] {
+			sorted = append(sorted, name)
+			delete(present, name)
+		}
+	}
+	for _, name := range names {
+		if present[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	return sorted
+}
+
+// naturalLess compares names case insensitively with runs of digits
+// compared by value, so "img2" comes before "img10". Names equal but for
+// case or leading zeros compare byte by byte.
+func naturalLess(a, b string) bool {
+	ra, rb := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	i, j := 0, 0
+	for i < len(ra) && j < len(rb) {
+		if isDigit(ra[i]) && isDigit(rb[j]) {
+			si, sj := i, j
+			for i < len(ra) && isDigit(ra[i]) {
+				i++
+			}
+			for j < len(rb) && isDigit(rb[j]) {
+				j++
+			}
+			// Numbers of any length compare by digit count, then digits.
+			na := strings.TrimLeft(string(ra[si:i]), "0")
+			nb := strings.TrimLeft(string(rb[sj:j]), "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+		if ra[i] != rb[j] {
+			return ra[i] < rb[j]
+		}
+		i++
+		j++
+	}
+	if len(ra)-i != len(rb)-j {
+		return len(ra)-i < len(rb)-j
+	}
+	return a < b
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
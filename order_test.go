@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	list := []struct {
+		a, b string
+		less bool
+	}{
+		{"img2.jpg", "img10.jpg", true},
+		{"img10.jpg", "img2.jpg", false},
+		{"img02.jpg", "img2.jpg", true},
+		{"img2.jpg", "img02.jpg", false},
+		{"img9.jpg", "img010.jpg", true},
+		{"IMG1.jpg", "img2.jpg", true},
+		{"a.jpg", "B.jpg", true},
+		{"B.jpg", "b.jpg", true},
+		{"img.jpg", "img1.jpg", true},
+		{"img1.jpg", "img1a.jpg", true},
+		{"2020-01-09", "2020-01-10", true},
+		{"a", "a", false},
+		{"", "a", true},
+		{"18446744073709551616", "1", false},
+		{"1", "18446744073709551616", true},
+		{"18446744073709551616", "18446744073709551617", true},
+	}
+	for _, item := range list {
+		if got := naturalLess(item.a, item.b); got != item.less {
+			t.Errorf("naturalLess(%q, %q) = %t, want %t", item.a, item.b, got, item.less)
+		}
+	}
+}
+
+func TestSortByOrderFile(t *testing.T) {
+	albumPath, err := ioutil.TempDir("", "photosite-order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(albumPath)
+
+	names := []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"}
+	list := []struct {
+		order string
+		want  []string
+	}{
+		{"", names},
+		{"c.jpg\na.jpg\n", []string{"c.jpg", "a.jpg", "b.jpg", "d.jpg"}},
+		{"d.jpg\r\nb.jpg\r\n", []string{"d.jpg", "b.jpg", "a.jpg", "c.jpg"}},
+		{"gone.jpg\nb.jpg\nb.jpg\n\n", []string{"b.jpg", "a.jpg", "c.jpg", "d.jpg"}},
+		{"d.jpg\nc.jpg\nb.jpg\na.jpg", []string{"d.jpg", "c.jpg", "b.jpg", "a.jpg"}},
+	}
+	orderPath := filepath.Join(albumPath, orderFile)
+	for _, item := range list {
+		os.Remove(orderPath)
+		if len(item.order) != 0 {
+			err = ioutil.WriteFile(orderPath, []byte(item.order), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := sortByOrderFile(albumPath, append([]string(nil), names...))
+		if !reflect.DeepEqual(got, item.want) {
+			t.Errorf("order %q: got %v, want %v", item.order, got, item.want)
+		}
+	}
+}
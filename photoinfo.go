@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Sidecar index of the EXIF metadata of every image in an album, kept in
+// the album cache folder.
+const photoInfoFile = "info.json"
+
+// Entries written by older versions are read again.
+const photoInfoVersion = 2
+
+var (
+	// Background updates started by albumPhotoInfo.
+	photoInfoUpdates sync.WaitGroup
+
+	photoInfoLocksLock sync.Mutex
+	// Serialize updates of each album info index, keyed by album path.
+	photoInfoLocks = map[string]*sync.Mutex{}
+)
+
+func photoInfoLock(albumPath string) *sync.Mutex {
+	photoInfoLocksLock.Lock()
+	defer photoInfoLocksLock.Unlock()
+	l, found := photoInfoLocks[albumPath]
+	if !found {
+		l = &sync.Mutex{}
+		photoInfoLocks[albumPath] = l
+	}
+	return l
+}
+
+// photoInfo is the EXIF metadata shown with an image. Zero values are unknown.
+type photoInfo struct {
+	Taken       time.Time `json:"taken,omitempty"`
+	Camera      string    `json:"camera,omitempty"`
+	Lens        string    `json:"lens,omitempty"`
+	Exposure    string    `json:"exposure,omitempty"`
+	FNumber     float64   `json:"fNumber,omitempty"`
+	FocalLength float64   `json:"focalLength,omitempty"`
+	ISO         int64     `json:"iso,omitempty"`
+	GPS         bool      `json:"gps,omitempty"`
+	Lat         float64   `json:"lat,omitempty"`
+	Long        float64   `json:"long,omitempty"`
+	Description string    `json:"description,omitempty"`
+	// Title is the XMP title.
+	Title string `json:"title,omitempty"`
+}
+
+// photoInfoEntry is the info of one image and the source modification time
+// it was read at.
+type photoInfoEntry struct {
+	Version int       `json:"version"`
+	ModTime int64     `json:"modTime"`
+	Info    photoInfo `json:"info"`
+}
+
+// albumPhotoInfo returns the indexed info of each image without reading
+// EXIF. Images that are new or changed since the index was written are
+// updated in the background and show their old or no info until then.
+func albumPhotoInfo(albumPath string, images []string) map[string]photoInfo {
+	indexPath := filepath.Join(albumPath, cacheDir, photoInfoFile)
+	index, _ := readPhotoInfoIndex(indexPath)
+	list := make(map[string]photoInfo, len(images))
+	var stale []string
+	for _, image := range images {
+		entry, found := index[image]
+		if !found || !entry.current(filepath.Join(albumPath, image)) {
+			stale = append(stale, image)
+		}
+		list[image] = entry.Info
+	}
+	if len(stale) != 0 {
+		photoInfoUpdates.Add(1)
+		go func() {
+			defer photoInfoUpdates.Done()
+			// Views of the album while the update runs do not start another.
+			cacheFlight.Do(indexPath, func() (interface{}, error) {
+				updatePhotoInfo(albumPath, stale, false)
+				return nil, nil
+			})
+		}()
+	}
+	return list
+}
+
+// updatePhotoInfo reads the EXIF of images that are new or changed since
+// the index was written. It is called by the cache workers and scans. If
+// all is set images lists the whole album and other entries are dropped.
+func updatePhotoInfo(albumPath string, images []string, all bool) {
+	l := photoInfoLock(albumPath)
+	l.Lock()
+	defer l.Unlock()
+
+	indexPath := filepath.Join(albumPath, cacheDir, photoInfoFile)
+	index, err := readPhotoInfoIndex(indexPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warning("Rebuilding corrupt %s: %v", indexPath, err)
+	}
+
+	changed := false
+	for _, image := range images {
+		filename := filepath.Join(albumPath, image)
+		fi, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		entry, found := index[image]
+		if found && entry.current(filename) {
+			continue
+		}
+		index[image] = photoInfoEntry{
+			Version: photoInfoVersion,
+			ModTime: fi.ModTime().Unix(),
+			Info:    readPhotoInfo(filename),
+		}
+		changed = true
+	}
+	if all {
+		listed := make(map[string]bool, len(images))
+		for _, image := range images {
+			listed[image] = true
+		}
+		for image := range index {
+			if !listed[image] {
+				delete(index, image)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+
+	bb, err := json.Marshal(index)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(indexPath), 0777)
+	}
+	if err == nil {
+		err = writeFileAtomic(indexPath, bb)
+	}
+	if err != nil {
+		log.Warning("Failed to write %s: %v", indexPath, err)
+	}
+}
+
+// readPhotoInfoIndex reads an album info index. A missing or corrupt index
+// returns an empty index along with the error.
+func readPhotoInfoIndex(indexPath string) (map[string]photoInfoEntry, error) {
+	index := map[string]photoInfoEntry{}
+	bb, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(bb, &index)
+	if err != nil {
+		return map[string]photoInfoEntry{}, err
+	}
+	return index, nil
+}
+
+// current reports if the entry was read from the file as it is now by this
+// version.
+func (entry photoInfoEntry) current(filename string) bool {
+	if entry.Version != photoInfoVersion {
+		return false
+	}
+	fi, err := os.Stat(filename)
+	return err == nil && entry.ModTime == fi.ModTime().Unix()
+}
+
+// readPhotoInfo decodes the EXIF metadata and XMP title of an image. Files
+// without EXIF return an empty info.
+func readPhotoInfo(filename string) (info photoInfo) {
+	if !isVideoName(filename) {
+		info.Title = readXMPTitle(filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return info
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return info
+	}
+	// Tag accessors panic on tags of an unexpected type.
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warning("Bad EXIF in %s: %v", filename, r)
+		}
+	}()
+
+	if t, err := x.DateTime(); err == nil {
+		info.Taken = t
+	}
+	// Many models already start with the make: "Canon" "Canon EOS 5D".
+	cameraMake := exifString(x, exif.Make)
+	info.Camera = exifString(x, exif.Model)
+	if !strings.HasPrefix(info.Camera, cameraMake) {
+		info.Camera = strings.TrimSpace(cameraMake + " " + info.Camera)
+	}
+	info.Lens = exifString(x, exif.LensModel)
+	info.Description = exifString(x, exif.ImageDescription)
+	if r := exifRat(x, exif.ExposureTime); r != nil && r.Sign() > 0 {
+		info.Exposure = formatExposure(r)
+	}
+	if r := exifRat(x, exif.FNumber); r != nil {
+		info.FNumber, _ = r.Float64()
+	}
+	if r := exifRat(x, exif.FocalLength); r != nil {
+		info.FocalLength, _ = r.Float64()
+	}
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil && tag.Count > 0 {
+		info.ISO = tag.Int(0)
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		info.GPS, info.Lat, info.Long = true, lat, long
+	}
+	return info
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(tag.StringVal(), "\x00"))
+}
+
+func exifRat(x *exif.Exif, name exif.FieldName) *big.Rat {
+	tag, err := x.Get(name)
+	if err != nil || tag.Count == 0 {
+		return nil
+	}
+	return tag.Rat(0)
+}
+
+// formatExposure writes exposures under a second as a fraction: 1/250.
+func formatExposure(r *big.Rat) string {
+	if r.Cmp(big.NewRat(1, 1)) >= 0 {
+		f, _ := r.Float64()
+		return fmt.Sprintf("%gs", f)
+	}
+	inv := new(big.Rat).Inv(r)
+	f, _ := inv.Float64()
+	return fmt.Sprintf("1/%.0fs", f)
+}
+
+// infoField is one labeled line of the viewer info panel.
+type infoField struct {
+	Label, Value string
+	// URL links the value if set.
+	URL string
+}
+
+// fields lists the known info, leaving out GPS coordinates unless showGPS.
+func (info photoInfo) fields(showGPS bool) []infoField {
+	var list []infoField
+	add := func(label, value string) {
+		if len(value) != 0 {
+			list = append(list, infoField{Label: label, Value: value})
+		}
+	}
+	if !info.Taken.IsZero() {
+		add("Taken", info.Taken.Format("2006-01-02 15:04"))
+	}
+	add("Camera", info.Camera)
+	add("Lens", info.Lens)
+	add("Exposure", info.Exposure)
+	if info.FNumber > 0 {
+		add("Aperture", fmt.Sprintf("f/%g", info.FNumber))
+	}
+	if info.FocalLength > 0 {
+		add("Focal length", fmt.Sprintf("%gmm", info.FocalLength))
+	}
+	if info.ISO > 0 {
+		add("ISO", fmt.Sprint(info.ISO))
+	}
+	if info.GPS && showGPS {
+		list = append(list, infoField{
+			Label: "Location",
+			Value: fmt.Sprintf("%.5f, %.5f", info.Lat, info.Long),
+			URL:   fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=15/%f/%f", info.Lat, info.Long, info.Lat, info.Long),
+		})
+	}
+	return list
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Camera RAW types, by lower case file extension.
+var rawExts = []string{".cr2", ".cr3", ".nef", ".nrw", ".arw", ".srf", ".sr2", ".orf", ".rw2", ".raf", ".pef", ".dng"}
+
+func init() {
+	registerDecoder(decodeRawPreview, ".jpg", rawExts...)
+}
+
+func isRawName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, raw := range rawExts {
+		if ext == raw {
+			return true
+		}
+	}
+	return false
+}
+
+func isJPEGName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+// shotKey matches a RAW file to the JPEG the camera wrote with it:
+// IMG_0001.CR2 and IMG_0001.JPG share the key img_0001.
+func shotKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// previewRange is where an embedded JPEG may start and how many bytes it
+// may take at most.
+type previewRange struct {
+	offset, size int64
+}
+
+// Longest IFD chain or SubIFD list followed, against loops in bad files.
+const maxIFDs = 32
+
+// decodeRawPreview decodes the largest JPEG embedded in a camera RAW file.
+// Full RAW decoding is not available, but every common format carries a
+// full or near full size preview. Only the headers and the previews are
+// read, not the sensor data.
+func decodeRawPreview(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var best image.Image
+	bestArea := 0
+	for _, p := range rawPreviews(f, fi.Size()) {
+		config, err := jpeg.DecodeConfig(io.NewSectionReader(f, p.offset, p.size))
+		if err != nil || config.Width*config.Height <= bestArea {
+			continue
+		}
+		img, err := jpeg.Decode(io.NewSectionReader(f, p.offset, p.size))
+		if err != nil {
+			continue
+		}
+		best, bestArea = img, config.Width*config.Height
+	}
+	if best == nil {
+		return nil, errNoPreview
+	}
+	return best, nil
+}
+
+// rawPreviews lists the embedded JPEGs of a RAW file from its headers.
+// Files of unknown layout are scanned for JPEG start markers.
+func rawPreviews(r io.ReaderAt, size int64) []previewRange {
+	head := make([]byte, 92)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("FUJIFILMCCD-RAW")) && len(head) >= 92:
+		// RAF keeps the offset and length of its preview in the header.
+		return []previewRange{{
+			offset: int64(binary.BigEndian.Uint32(head[84:])),
+			size:   int64(binary.BigEndian.Uint32(head[88:])),
+		}}
+	case len(head) >= 8 && string(head[:2]) == "II":
+		return tiffPreviews(r, binary.LittleEndian, int64(binary.LittleEndian.Uint32(head[4:])))
+	case len(head) >= 8 && string(head[:2]) == "MM":
+		return tiffPreviews(r, binary.BigEndian, int64(binary.BigEndian.Uint32(head[4:])))
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		return boxPreviews(r, size)
+	}
+	return scanPreviews(r, 0, size)
+}
+
+// tiffPreviews follows the IFD chain and SubIFDs of a TIFF based RAW file:
+// CR2, NEF, ARW, DNG, ORF, RW2, PEF and others. Previews are JPEG
+// thumbnails, JPEG compressed strips or the RW2 JpgFromRaw tag.
+func tiffPreviews(r io.ReaderAt, bo binary.ByteOrder, ifd int64) []previewRange {
+	var list []previewRange
+	queue := []int64{ifd}
+	seen := map[int64]bool{}
+	for len(queue) != 0 && len(seen) < maxIFDs {
+		ifd, queue = queue[0], queue[1:]
+		if ifd == 0 || seen[ifd] {
+			continue
+		}
+		seen[ifd] = true
+
+		b := make([]byte, 2)
+		if _, err := r.ReadAt(b, ifd); err != nil {
+			continue
+		}
+		count := int64(bo.Uint16(b))
+		b = make([]byte, count*12+4)
+		if _, err := r.ReadAt(b, ifd+2); err != nil {
+			continue
+		}
+		var jpegOffset, jpegSize, stripOffset, stripSize, compression int64
+		for i := int64(0); i < count; i++ {
+			entry := b[i*12 : i*12+12]
+			tag, typ, n := bo.Uint16(entry), bo.Uint16(entry[2:]), int64(bo.Uint32(entry[4:]))
+			value := int64(bo.Uint32(entry[8:]))
+			if typ == 3 {
+				// SHORT values are left aligned.
+				value = int64(bo.Uint16(entry[8:]))
+			}
+			switch tag {
+			case 0x002E:
+				// RW2 JpgFromRaw, the count is the length in bytes.
+				list = append(list, previewRange{offset: value, size: n})
+			case 0x0103:
+				compression = value
+			case 0x0111:
+				if n == 1 {
+					stripOffset = value
+				}
+			case 0x0117:
+				if n == 1 {
+					stripSize = value
+				}
+			case 0x014A:
+				if n == 1 {
+					queue = append(queue, value)
+					continue
+				}
+				if n > maxIFDs {
+					continue
+				}
+				subs := make([]byte, n*4)
+				if _, err := r.ReadAt(subs, value); err != nil {
+					continue
+				}
+				for j := int64(0); j < n; j++ {
+					queue = append(queue, int64(bo.Uint32(subs[j*4:])))
+				}
+			case 0x0201:
+				jpegOffset = value
+			case 0x0202:
+				jpegSize = value
+			}
+		}
+		if jpegOffset != 0 && jpegSize != 0 {
+			list = append(list, previewRange{offset: jpegOffset, size: jpegSize})
+		}
+		// Old and new style JPEG compression.
+		if (compression == 6 || compression == 7) && stripOffset != 0 && stripSize != 0 {
+			list = append(list, previewRange{offset: stripOffset, size: stripSize})
+		}
+		queue = append(queue, int64(bo.Uint32(b[count*12:])))
+	}
+	return list
+}
+
+// boxPreviews scans the top level boxes of an ISO media based RAW file,
+// such as CR3, for JPEGs, skipping the sensor data in the mdat box.
+func boxPreviews(r io.ReaderAt, size int64) []previewRange {
+	var list []previewRange
+	header := make([]byte, 16)
+	for offset := int64(0); offset+8 <= size; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			break
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header))
+		boxType := string(header[4:8])
+		switch boxSize {
+		case 0:
+			// The box runs to the end of the file.
+			boxSize = size - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:], offset+8); err != nil {
+				return list
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:]))
+		}
+		if boxSize < 8 || offset+boxSize > size {
+			break
+		}
+		if boxType != "mdat" {
+			list = append(list, scanPreviews(r, offset, offset+boxSize)...)
+		}
+		offset += boxSize
+	}
+	return list
+}
+
+// scanPreviews finds JPEG start markers between start and end, reading a
+// block at a time.
+func scanPreviews(r io.ReaderAt, start, end int64) []previewRange {
+	var list []previewRange
+	soi := []byte{0xFF, 0xD8, 0xFF}
+	block := make([]byte, 64*1024)
+	for at := start; at < end; {
+		b := block
+		if end-at < int64(len(b)) {
+			b = b[:end-at]
+		}
+		n, err := r.ReadAt(b, at)
+		b = b[:n]
+		for i := 0; ; i++ {
+			next := bytes.Index(b[i:], soi)
+			if next < 0 {
+				break
+			}
+			i += next
+			list = append(list, previewRange{offset: at + int64(i), size: end - at - int64(i)})
+		}
+		if err != nil || n <= len(soi) {
+			break
+		}
+		// Overlap blocks so a marker across the boundary is found.
+		at += int64(n - len(soi) + 1)
+	}
+	return list
+}
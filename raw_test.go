@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testJPEG(t *testing.T, size int) []byte {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, size, size)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testTIFF builds a little endian TIFF with a JPEG thumbnail in IFD0 and a
+// JPEG strip in a SubIFD, followed by data no IFD points to.
+func testTIFF(thumb, strip, rest []byte) []byte {
+	const ifdSize = 2 + 3*12 + 4
+	le := binary.LittleEndian
+	var b bytes.Buffer
+	b.WriteString("II*\x00")
+	binary.Write(&b, le, uint32(8))
+	ifd := func(entries [3][3]uint32) {
+		binary.Write(&b, le, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&b, le, uint16(e[0]))
+			binary.Write(&b, le, uint16(e[1]))
+			binary.Write(&b, le, uint32(1))
+			binary.Write(&b, le, e[2])
+		}
+		binary.Write(&b, le, uint32(0))
+	}
+	sub := uint32(8 + ifdSize)
+	thumbAt := sub + ifdSize
+	stripAt := thumbAt + uint32(len(thumb))
+	ifd([3][3]uint32{{0x014A, 4, sub}, {0x0201, 4, thumbAt}, {0x0202, 4, uint32(len(thumb))}})
+	ifd([3][3]uint32{{0x0103, 3, 6}, {0x0111, 4, stripAt}, {0x0117, 4, uint32(len(strip))}})
+	b.Write(thumb)
+	b.Write(strip)
+	b.Write(rest)
+	return b.Bytes()
+}
+
+func testBox(typ string, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(b, uint32(8+len(data)))
+	copy(b[4:], typ)
+	return append(b, data...)
+}
+
+// The largest preview the headers point to is decoded, JPEGs elsewhere in
+// the file are not read.
+func TestDecodeRawPreview(t *testing.T) {
+	dir, err := ioutil.TempDir("", "photosite-raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	small, large, unread := testJPEG(t, 8), testJPEG(t, 16), testJPEG(t, 32)
+
+	raf := make([]byte, 100)
+	copy(raf, "FUJIFILMCCD-RAW 0201")
+	binary.BigEndian.PutUint32(raf[84:], uint32(len(raf)))
+	binary.BigEndian.PutUint32(raf[88:], uint32(len(large)))
+	raf = append(append(raf, large...), unread...)
+
+	cr3 := testBox("ftyp", []byte("crx \x00\x00\x00\x01"))
+	cr3 = append(cr3, testBox("uuid", append(make([]byte, 16), large...))...)
+	cr3 = append(cr3, testBox("mdat", unread)...)
+
+	list := []struct {
+		name string
+		data []byte
+		size int
+	}{
+		{"a.cr2", testTIFF(small, large, unread), 16},
+		{"b.nef", testTIFF(large, small, unread), 16},
+		{"c.raf", raf, 16},
+		{"d.cr3", cr3, 16},
+		{"e.srf", append([]byte("unknown"), small...), 8},
+		{"f.cr2", testTIFF(nil, nil, unread), 0},
+	}
+	for _, item := range list {
+		filename := filepath.Join(dir, item.name)
+		err := ioutil.WriteFile(filename, item.data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := decodeRawPreview(filename)
+		if item.size == 0 {
+			if err != errNoPreview {
+				t.Errorf("%s: error = %v, want %v", item.name, err, errNoPreview)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", item.name, err)
+			continue
+		}
+		if w := img.Bounds().Dx(); w != item.size {
+			t.Errorf("%s: got a %d wide preview, want %d", item.name, w, item.size)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// resample controls how one image size is built.
+type resample struct {
+	// Filter is a name from resampleFilters.
+	Filter string `json:"filter"`
+	// Quality of JPEG and WebP output, 1 to 100.
+	Quality int `json:"quality"`
+	// Sharpen is the sigma of an unsharp pass after resizing, 0 for none.
+	Sharpen float64 `json:"sharpen"`
+	// Progressive JPEG output is drawn coarse first while it loads.
+	Progressive bool `json:"progressive"`
+}
+
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"nearest":    imaging.NearestNeighbor,
+	"box":        imaging.Box,
+	"linear":     imaging.Linear,
+	"hermite":    imaging.Hermite,
+	"mitchell":   imaging.MitchellNetravali,
+	"catmullrom": imaging.CatmullRom,
+	"bspline":    imaging.BSpline,
+	"gaussian":   imaging.Gaussian,
+	"lanczos":    imaging.Lanczos,
+}
+
+// key changes with any setting, so cache files built with other settings
+// are not used.
+func (rs resample) key() string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d/%g", rs.Filter, rs.Quality, rs.Sharpen)
+	// Only hashed when set, so existing cache files stay current.
+	if rs.Progressive {
+		fmt.Fprint(h, "/progressive")
+	}
+	return strconv.FormatUint(uint64(h.Sum32()), 36)
+}
+
+// resampleSizes holds the settings of configured sizes. It is set as a JSON
+// object keyed by size: {"200": {"filter": "lanczos", "quality": 85}}.
+type resampleSizes map[int]resample
+
+func (rs *resampleSizes) String() string {
+	if rs == nil || len(*rs) == 0 {
+		return ""
+	}
+	list := make(map[string]resample, len(*rs))
+	for size, r := range *rs {
+		list[strconv.Itoa(size)] = r
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+func (rs *resampleSizes) Set(s string) error {
+	list := map[string]resample{}
+	err := json.Unmarshal([]byte(s), &list)
+	if err != nil {
+		return err
+	}
+	set := make(resampleSizes, len(list))
+	for key, r := range list {
+		size, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("Bad size %q", key)
+		}
+		set[size] = r
+	}
+	*rs = set
+	return nil
+}
+
+// forSize returns the settings of a size, filling unset fields with
+// defaults: Lanczos for thumbnails and CatmullRom for larger views.
+func (rs resampleSizes) forSize(size int) resample {
+	r := rs[size]
+	if len(r.Filter) == 0 {
+		r.Filter = "catmullrom"
+		if size <= thumbSize {
+			r.Filter = "lanczos"
+		}
+	}
+	if r.Quality == 0 {
+		r.Quality = 85
+	}
+	return r
+}
+
+func (rs resampleSizes) validate() []string {
+	var problems []string
+	keys := make([]int, 0, len(rs))
+	for size := range rs {
+		keys = append(keys, size)
+	}
+	sort.Ints(keys)
+	for _, size := range keys {
+		r := rs[size]
+		if !sizes.contains(size) && !squareSizes.contains(size) {
+			problems = append(problems, fmt.Sprintf("resample size %d is not one of sizes or squareSizes", size))
+		}
+		if _, found := resampleFilters[r.Filter]; len(r.Filter) != 0 && !found {
+			problems = append(problems, fmt.Sprintf("resample filter %q for size %d is unknown", r.Filter, size))
+		}
+		if r.Quality < 0 || r.Quality > 100 {
+			problems = append(problems, fmt.Sprintf("resample quality for size %d must be between 1 and 100", size))
+		}
+		if r.Sharpen < 0 {
+			problems = append(problems, fmt.Sprintf("resample sharpen for size %d must not be negative", size))
+		}
+	}
+	return problems
+}
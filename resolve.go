@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route parameters are resolved to files only through these functions.
+// Each name must be a plain name, not "..", a dot-file or a path, and
+// after following symbolic links a group must stay inside the groups
+// folder, an album inside its group and an image inside its album.
+
+var (
+	errBadPath  = errors.New("Bad path")
+	errNotFound = errors.New("Not found")
+)
+
+// validName reports if name is a single file or folder name that is not
+// hidden.
+func validName(name string) bool {
+	return len(name) != 0 && name[0] != '.' && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// validAlbum reports if album is a path of album names: "a" or "a/b".
+func validAlbum(album string) bool {
+	for _, name := range strings.Split(album, "/") {
+		if !validName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// inside returns an error unless p is inside the folder base after
+// following symbolic links in both.
+func inside(base, p string) error {
+	realBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realBase, real)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errBadPath
+	}
+	return nil
+}
+
+// resolveGroup returns the folder of a group.
+func resolveGroup(group string) (string, error) {
+	if !validName(group) {
+		return "", errBadPath
+	}
+	p := filepath.Join(root, groupsFolder, group)
+	return p, checkFolder(filepath.Join(root, groupsFolder), p)
+}
+
+// resolveAlbum returns the folder of an existing album.
+func resolveAlbum(group, album string) (string, error) {
+	groupPath, err := resolveGroup(group)
+	if err != nil {
+		return "", err
+	}
+	if !validAlbum(album) {
+		return "", errBadPath
+	}
+	p := albumFolder(group, album)
+	return p, checkFolder(groupPath, p)
+}
+
+func checkFolder(base, p string) error {
+	err := inside(base, p)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return errNotFound
+	}
+	return nil
+}
+
+// resolveImage returns the album folder and file of an image or video
+// listed in the album.
+func resolveImage(group, album, image string) (albumPath, filename string, err error) {
+	albumPath, err = resolveAlbum(group, album)
+	if err != nil {
+		return "", "", err
+	}
+	if !validName(image) || !isImageName(image) {
+		return "", "", errBadPath
+	}
+	found, err := albumListed(albumPath, image)
+	if err != nil {
+		return "", "", err
+	}
+	if !found {
+		return "", "", errNotFound
+	}
+	filename = filepath.Join(albumPath, image)
+	err = inside(albumPath, filename)
+	if err != nil {
+		return "", "", err
+	}
+	return albumPath, filename, nil
+}
+
+// albumListing is the set of image names in an album folder as of the
+// folder modification time.
+type albumListing struct {
+	modTime time.Time
+	names   map[string]bool
+	// RAW file names by shotKey.
+	raws map[string]string
+}
+
+var (
+	albumListingsLock sync.Mutex
+	albumListings     = map[string]albumListing{}
+)
+
+// Folders changed this recently are listed again on every call, as a file
+// added within the same clock tick leaves the modification time unchanged.
+const listingSettleTime = 2 * time.Second
+
+// albumListed reports if image is listed in the album folder, including
+// RAW files getImages leaves out for their JPEG.
+func albumListed(albumPath, image string) (bool, error) {
+	listing, err := readAlbumListing(albumPath)
+	if err != nil {
+		return false, err
+	}
+	return listing.names[image], nil
+}
+
+// pairedRaw returns the RAW file shot together with a JPEG image, or "".
+func pairedRaw(albumPath, image string) string {
+	if !isJPEGName(image) {
+		return ""
+	}
+	listing, err := readAlbumListing(albumPath)
+	if err != nil {
+		return ""
+	}
+	return listing.raws[shotKey(image)]
+}
+
+// readAlbumListing lists the images of an album folder. The folder is read
+// again only when its modification time changes, so checking each image of
+// an album does not list the album each time.
+func readAlbumListing(albumPath string) (albumListing, error) {
+	fi, err := os.Stat(albumPath)
+	if err != nil {
+		return albumListing{}, err
+	}
+	albumListingsLock.Lock()
+	listing, found := albumListings[albumPath]
+	albumListingsLock.Unlock()
+	if found && listing.modTime.Equal(fi.ModTime()) {
+		return listing, nil
+	}
+
+	files, err := albumFiles(albumPath)
+	if err != nil {
+		return albumListing{}, err
+	}
+	listing = albumListing{
+		modTime: fi.ModTime(),
+		names:   make(map[string]bool, len(files)),
+		raws:    make(map[string]string),
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !isImageName(name) {
+			continue
+		}
+		listing.names[name] = true
+		if isRawName(name) {
+			listing.raws[shotKey(name)] = name
+		}
+	}
+	if time.Since(fi.ModTime()) >= listingSettleTime {
+		albumListingsLock.Lock()
+		albumListings[albumPath] = listing
+		albumListingsLock.Unlock()
+	}
+	return listing, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// makeTestRoot creates a root with groups g and other, and files and links
+// that must not be reachable from routes.
+func makeTestRoot(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "photosite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []string{
+		"secret.jpg",
+		"outside/secret.jpg",
+		"groups/g/a/img.jpg",
+		"groups/g/a/.dot.jpg",
+		"groups/g/a/notes.txt",
+		"groups/g/a/b/pic.png",
+		"groups/g/.cache/img.jpg",
+		"groups/g/a/.cache/img@200.jpg",
+		"groups/other/x/y.jpg",
+	}
+	for _, name := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(p), 0777)
+		if err == nil {
+			err = ioutil.WriteFile(p, []byte("image"), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"groups/g/a/link.jpg": "secret.jpg",
+		"groups/g/out":        "outside",
+		"groups/g/x":          "groups/other/x",
+	}
+	for name, target := range links {
+		err = os.Symlink(filepath.Join(dir, target), filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Skipf("Symbolic links not supported: %v", err)
+		}
+	}
+	oldRoot, oldLog := root, log
+	root, log = dir, consoleLogger{}
+	return dir, func() {
+		photoInfoUpdates.Wait()
+		root, log = oldRoot, oldLog
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResolveImage(t *testing.T) {
+	_, done := makeTestRoot(t)
+	defer done()
+
+	list := []struct {
+		group, album, image string
+		ok                  bool
+	}{
+		{"g", "a", "img.jpg", true},
+		{"g", "a/b", "pic.png", true},
+
+		{"g", "a", "missing.jpg", false},
+		{"g", "a", "notes.txt", false},
+		{"g", "a", ".dot.jpg", false},
+		{"g", "a", "..", false},
+		{"g", "a", ".", false},
+		{"g", "a", "", false},
+		{"g", "a", "../a/img.jpg", false},
+		{"g", "a", `..\a\img.jpg`, false},
+		{"g", "a", "b/pic.png", false},
+		{"g", "a", "img.jpg\x00.png", false},
+		{"g", "a", "link.jpg", false},
+		{"g", "a/.cache", "img@200.jpg", false},
+		{"g", ".cache", "img.jpg", false},
+		{"g", "a/b/..", "img.jpg", false},
+		{"g", "a/../a", "img.jpg", false},
+		{"g", "/a", "img.jpg", false},
+		{"g", "a/", "img.jpg", false},
+		{"g", "", "img.jpg", false},
+		{"g", "..", "secret.jpg", false},
+		{"g", "../..", "secret.jpg", false},
+		{"g", "out", "secret.jpg", false},
+		{"g", "x", "y.jpg", false},
+		{"g", `a\b`, "pic.png", false},
+		{"..", "g/a", "img.jpg", false},
+		{"g/a", "b", "pic.png", false},
+		{"", "g/a", "img.jpg", false},
+		{"other/../g", "a", "img.jpg", false},
+	}
+	for _, item := range list {
+		_, filename, err := resolveImage(item.group, item.album, item.image)
+		if item.ok && err != nil {
+			t.Errorf("%q %q %q: unexpected error %v", item.group, item.album, item.image, err)
+		}
+		if !item.ok && err == nil {
+			t.Errorf("%q %q %q: resolved to %s", item.group, item.album, item.image, filename)
+		}
+	}
+}
+
+func TestResolveAlbum(t *testing.T) {
+	_, done := makeTestRoot(t)
+	defer done()
+
+	list := []struct {
+		group, album string
+		ok           bool
+	}{
+		{"g", "a", true},
+		{"g", "a/b", true},
+
+		{"g", "missing", false},
+		{"g", "a/img.jpg", false},
+		{"g", ".cache", false},
+		{"g", "..", false},
+		{"g", "a/..", false},
+		{"g", "a//b", false},
+		{"g", "out", false},
+		{"g", "x", false},
+		{"..", "..", false},
+		{".", "g", false},
+	}
+	for _, item := range list {
+		p, err := resolveAlbum(item.group, item.album)
+		if item.ok && err != nil {
+			t.Errorf("%q %q: unexpected error %v", item.group, item.album, err)
+		}
+		if !item.ok && err == nil {
+			t.Errorf("%q %q: resolved to %s", item.group, item.album, p)
+		}
+	}
+}
+
+// The cached listing follows files added and removed from the album.
+func TestAlbumListed(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+
+	albumPath := filepath.Join(dir, "groups", "g", "a")
+	// Folder times past listingSettleTime so listings are cached.
+	setFolderTime := func(age time.Duration) {
+		at := time.Now().Add(-age)
+		err := os.Chtimes(albumPath, at, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(image string, want bool) {
+		found, err := albumListed(albumPath, image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != want {
+			t.Errorf("albumListed(%q) = %t, want %t", image, found, want)
+		}
+	}
+
+	setFolderTime(time.Hour)
+	check("img.jpg", true)
+	check("new.jpg", false)
+	check("notes.txt", false)
+	check(".dot.jpg", false)
+	check("b", false)
+
+	err := ioutil.WriteFile(filepath.Join(albumPath, "new.jpg"), []byte("image"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFolderTime(time.Minute)
+	check("new.jpg", true)
+
+	err = os.Remove(filepath.Join(albumPath, "img.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("img.jpg", false)
+}
+
+// A RAW file with a same named JPEG is not listed but can still be
+// downloaded from the JPEG.
+func TestPairedRaw(t *testing.T) {
+	dir, done := makeTestRoot(t)
+	defer done()
+
+	albumPath := filepath.Join(dir, "groups", "g", "a")
+	for _, name := range []string{"IMG_1.JPG", "IMG_1.CR2", "solo.nef"} {
+		err := ioutil.WriteFile(filepath.Join(albumPath, name), []byte("image"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, images, err := getImages(albumPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]bool{}
+	for _, image := range images {
+		listed[image] = true
+	}
+	if listed["IMG_1.CR2"] || !listed["IMG_1.JPG"] || !listed["solo.nef"] {
+		t.Errorf("Got images %v, want IMG_1.JPG and solo.nef without IMG_1.CR2", images)
+	}
+	if _, _, err := resolveImage("g", "a", "IMG_1.CR2"); err != nil {
+		t.Errorf("Paired RAW not resolved: %v", err)
+	}
+	if raw := pairedRaw(albumPath, "IMG_1.JPG"); raw != "IMG_1.CR2" {
+		t.Errorf("pairedRaw(IMG_1.JPG) = %q, want IMG_1.CR2", raw)
+	}
+	if raw := pairedRaw(albumPath, "img.jpg"); raw != "" {
+		t.Errorf("pairedRaw(img.jpg) = %q, want none", raw)
+	}
+}
@@ -13,9 +13,17 @@ type Session interface {
 	Delete(username string) (err error)
 	DeleteKey(key string) (err error)
 	ExpireBefore(update time.Time, create time.Time) (err error)
+	List() (list []Info, err error)
 	Close() error
 }
 
+// Info describes an active session without exposing its key.
+type Info struct {
+	Username string
+	Create   time.Time
+	Update   time.Time
+}
+
 type Length struct {
 	Username string
 	Start    time.Time
@@ -130,6 +138,21 @@ func (s *MemorySessionList) ExpireBefore(update time.Time, create time.Time) (er
 
 	return nil
 }
+func (s *MemorySessionList) List() (list []Info, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	list = make([]Info, 0, len(s.list))
+	for _, item := range s.list {
+		list = append(list, Info{
+			Username: item.username,
+			Create:   item.create,
+			Update:   item.update,
+		})
+	}
+
+	return list, nil
+}
 func (s *MemorySessionList) Close() error {
 	return nil
 }
@@ -303,6 +303,44 @@ func (s *DiskSessionList) ExpireBefore(update time.Time, create time.Time) (err
 
 	return nil
 }
+func (s *DiskSessionList) List() (list []Info, err error) {
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	bucket := tx.Bucket(diskBucketName)
+	if bucket == nil {
+		return nil, diskCantOpenBucket
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	item := &diskSessionItem{}
+	err = bucket.ForEach(func(k, v []byte) error {
+		err := diskDecode(v, item)
+		if err != nil {
+			return err
+		}
+		// Include updates not yet written by ExpireBefore.
+		if update, found := s.updates[base64.StdEncoding.EncodeToString(k)]; found {
+			item.update = update
+		}
+		list = append(list, Info{
+			Username: item.username,
+			Create:   item.create,
+			Update:   item.update,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
 
 func (s *DiskSessionList) Close() error {
 	return s.db.Close()
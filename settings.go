@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	settingsFileName = "photosite.json"
+	envPrefix        = "PHOTOSITE_"
+)
+
+// Deployment settings. The values here are the defaults, overridden in order
+// by the settings file, PHOTOSITE_* environment variables and command line flags.
+var (
+	siteName = "Photo Site"
+	domain   = "photosite.com"
+	root     = exeDir()
+
+	diskSession      = true
+	secureConnection = false
+	plainAddr        = ":8080"
+	tlsAddr          = ":8081"
+
+	// Zero derives the interval from expireSessionTime, see expireInterval.
+	checkExpireTime   = time.Duration(0)
+	expireSessionTime = 2 * time.Hour
+	maxSessionTime    = 24 * time.Hour
+	reloadUserTime    = time.Minute
+
+	minUsernameLength = 8
+	minPasswordLength = 6
+
+	maxUploadSize int64 = 64 << 20
+
+	cacheWorkers  = runtime.NumCPU()
+	cacheScanTime = time.Hour
+	watchGroups   = true
+
+	// Image sizes that may be requested and cached, the thumbnail size
+	// shown in albums and the size linked when the viewer can not choose.
+	sizes     = intList{200, 1280}
+	thumbSize = 200
+	viewSize  = 1280
+
+	// Formats cached and served in addition to the source format.
+	formats = stringList{formatWebP}
+
+	// Per size resize and encode settings.
+	resampling = resampleSizes{}
+
+	// Square cropped sizes, used for album thumbnails if squareThumbs is set.
+	squareSizes  = intList{200}
+	squareThumbs = false
+	squareCrop   = cropSmart
+
+	// Program used to extract video poster frames.
+	ffmpegPath = "ffmpeg"
+
+	// Image order of albums without a sort file: date, name, mtime or manual.
+	defaultSort = sortModTime
+
+	// Groups whose members only see photo GPS coordinates if they are editors.
+	hideGPS = stringList{}
+
+	// Groups whose members may download original files. Editors and users
+	// with the download role may also download, unless the group hides GPS.
+	downloadGroups = stringList{}
+)
+
+var (
+	settingsFile string
+
+	// Flags given on the command line, re-applied after the settings file
+	// and environment so they take precedence.
+	settingsArgs []string
+
+	// Each flag name is also the settings file key and, upper cased with
+	// envPrefix, the environment variable name.
+	settingsFlags = flag.NewFlagSet("photosite", flag.ExitOnError)
+)
+
+func init() {
+	fs := settingsFlags
+	fs.StringVar(&settingsFile, "config", "", "Settings file (default <root>/"+settingsFileName+")")
+
+	fs.StringVar(&siteName, "siteName", siteName, "Site name shown in page titles")
+	fs.StringVar(&domain, "domain", domain, "Domain used for TLS and redirects")
+	fs.StringVar(&root, "root", root, "Folder containing groups, users, templates and lib")
+
+	fs.BoolVar(&diskSession, "diskSession", diskSession, "Persist sessions to disk")
+	fs.BoolVar(&secureConnection, "secureConnection", secureConnection, "Serve over TLS and redirect plain requests")
+	fs.StringVar(&plainAddr, "plainAddr", plainAddr, "Plain HTTP listen address")
+	fs.StringVar(&tlsAddr, "tlsAddr", tlsAddr, "TLS listen address")
+
+	fs.DurationVar(&checkExpireTime, "checkExpireTime", checkExpireTime, "Interval between session expire checks, at most 1m; 0 for expireSessionTime/10")
+	fs.DurationVar(&expireSessionTime, "expireSessionTime", expireSessionTime, "Idle time before a session expires")
+	fs.DurationVar(&maxSessionTime, "maxSessionTime", maxSessionTime, "Maximum session length")
+	fs.DurationVar(&reloadUserTime, "reloadUserTime", reloadUserTime, "Interval between users file reloads")
+
+	fs.IntVar(&minUsernameLength, "minUsernameLength", minUsernameLength, "Minimum username length")
+	fs.IntVar(&minPasswordLength, "minPasswordLength", minPasswordLength, "Minimum password length")
+
+	fs.Int64Var(&maxUploadSize, "maxUploadSize", maxUploadSize, "Largest uploaded image in bytes")
+
+	fs.IntVar(&cacheWorkers, "cacheWorkers", cacheWorkers, "Number of concurrent image resizes")
+	fs.DurationVar(&cacheScanTime, "cacheScanTime", cacheScanTime, "Interval between scans for uncached images, 0 to only scan at start")
+	fs.BoolVar(&watchGroups, "watchGroups", watchGroups, "Watch the groups folder and re-cache changed images")
+
+	fs.Var(&sizes, "sizes", "Comma separated image sizes to serve")
+	fs.IntVar(&thumbSize, "thumbSize", thumbSize, "Album thumbnail size, one of sizes")
+	fs.IntVar(&viewSize, "viewSize", viewSize, "Default large view size, one of sizes")
+	fs.Var(&resampling, "resample", `JSON resize settings by size: {"200": {"filter": "lanczos", "quality": 85, "sharpen": 0.5, "progressive": true}}`)
+	fs.Var(&squareSizes, "squareSizes", "Comma separated square cropped image sizes to serve")
+	fs.BoolVar(&squareThumbs, "squareThumbs", squareThumbs, "Show square cropped album thumbnails")
+	fs.StringVar(&squareCrop, "squareCrop", squareCrop, "Square crop mode: center or smart")
+	fs.StringVar(&ffmpegPath, "ffmpegPath", ffmpegPath, "ffmpeg program used for video poster frames")
+	fs.StringVar(&defaultSort, "defaultSort", defaultSort, "Image order of albums without a .sort file: date, name, mtime or manual")
+	fs.Var(&hideGPS, "hideGPS", "Comma separated groups whose viewers do not see photo locations")
+	fs.Var(&downloadGroups, "downloadGroups", "Comma separated groups whose members may download original files")
+	fs.Var(&formats, "formats", "Comma separated formats served to browsers that accept them: webp, avif")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [install | remove | run | start | stop | user | cache]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+}
+
+// intList is a comma separated flag value. Surrounding brackets are
+// ignored so JSON arrays may be used in the settings file.
+type intList []int
+
+func (l *intList) String() string {
+	list := make([]string, len(*l))
+	for i, v := range *l {
+		list[i] = strconv.Itoa(v)
+	}
+	return strings.Join(list, ",")
+}
+
+func (l *intList) Set(s string) error {
+	s = strings.Trim(s, "[] ")
+	var list intList
+	for _, item := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return err
+		}
+		list = append(list, v)
+	}
+	*l = list
+	return nil
+}
+
+func (l intList) contains(v int) bool {
+	for _, item := range l {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// stringList is a comma separated flag value, also accepting JSON arrays.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	s = strings.Trim(s, "[] ")
+	var list stringList
+	for _, item := range strings.Split(s, ",") {
+		item = strings.Trim(item, "\" ")
+		if len(item) != 0 {
+			list = append(list, item)
+		}
+	}
+	*l = list
+	return nil
+}
+
+func (l stringList) contains(v string) bool {
+	for _, item := range l {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+func exeDir() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "."
+	}
+	return filepath.Dir(exe)
+}
+
+// parseFlags parses the leading command line flags and leaves the remaining
+// arguments in os.Args for stdservice.
+func parseFlags() {
+	settingsFlags.Parse(os.Args[1:])
+	rest := settingsFlags.Args()
+	settingsArgs = os.Args[1 : len(os.Args)-len(rest)]
+	os.Args = append(os.Args[:1], rest...)
+}
+
+// loadSettings applies the settings file, environment and command line flags
+// on top of the defaults, then validates the result.
+func loadSettings() error {
+	if settingsFile == "" {
+		settingsFile = os.Getenv(envPrefix + "CONFIG")
+	}
+	filename := settingsFile
+	if filename == "" {
+		filename = filepath.Join(root, settingsFileName)
+	}
+	err := loadSettingsFile(filename, settingsFile != "")
+	if err != nil {
+		return err
+	}
+
+	var envErr error
+	settingsFlags.VisitAll(func(f *flag.Flag) {
+		v, found := os.LookupEnv(envPrefix + strings.ToUpper(f.Name))
+		if !found || envErr != nil {
+			return
+		}
+		err := f.Value.Set(v)
+		if err != nil {
+			envErr = fmt.Errorf("Bad value for %s%s: %v", envPrefix, strings.ToUpper(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return envErr
+	}
+
+	err = settingsFlags.Parse(settingsArgs)
+	if err != nil {
+		return err
+	}
+	return validateSettings()
+}
+
+// loadSettingsFile reads a JSON object whose keys are flag names. A missing
+// file is only an error if it was asked for explicitly.
+func loadSettingsFile(filename string, required bool) error {
+	bb, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return err
+	}
+	values := map[string]json.RawMessage{}
+	err = json.Unmarshal(bb, &values)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", filename, err)
+	}
+	for name, raw := range values {
+		f := settingsFlags.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("Unknown setting %q in %s", name, filename)
+		}
+		v := string(raw)
+		if len(raw) > 0 && raw[0] == '"' {
+			err = json.Unmarshal(raw, &v)
+			if err != nil {
+				return fmt.Errorf("Bad value for %q in %s: %v", name, filename, err)
+			}
+		}
+		err = f.Value.Set(v)
+		if err != nil {
+			return fmt.Errorf("Bad value for %q in %s: %v", name, filename, err)
+		}
+	}
+	return nil
+}
+
+func validateSettings() error {
+	var problems []string
+	bad := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		bad("root %q is not a folder", root)
+	}
+	if len(siteName) == 0 {
+		bad("siteName is empty")
+	}
+	if len(plainAddr) == 0 {
+		bad("plainAddr is empty")
+	}
+	if secureConnection {
+		if len(tlsAddr) == 0 {
+			bad("tlsAddr is empty")
+		}
+		if len(domain) == 0 {
+			bad("domain is empty")
+		}
+	}
+	if checkExpireTime < 0 || checkExpireTime > maxExpireInterval {
+		bad("checkExpireTime must be between 0 and %v", maxExpireInterval)
+	}
+	if expireSessionTime <= 0 {
+		bad("expireSessionTime must be positive")
+	}
+	if maxSessionTime < expireSessionTime {
+		bad("maxSessionTime must not be less than expireSessionTime")
+	}
+	if reloadUserTime <= 0 {
+		bad("reloadUserTime must be positive")
+	}
+	if minUsernameLength < 1 {
+		bad("minUsernameLength must be at least 1")
+	}
+	if minPasswordLength < 1 {
+		bad("minPasswordLength must be at least 1")
+	}
+	if maxUploadSize <= 0 {
+		bad("maxUploadSize must be positive")
+	}
+	if cacheWorkers < 1 {
+		bad("cacheWorkers must be at least 1")
+	}
+	if cacheScanTime < 0 {
+		bad("cacheScanTime must not be negative")
+	}
+	if len(sizes) == 0 {
+		bad("sizes is empty")
+	}
+	for i, size := range sizes {
+		if size <= 0 {
+			bad("sizes must be positive")
+			break
+		}
+		if i > 0 && size <= sizes[i-1] {
+			bad("sizes must be listed smallest first without repeats")
+			break
+		}
+	}
+	if !sizes.contains(thumbSize) {
+		bad("thumbSize %d is not one of sizes", thumbSize)
+	}
+	if !sizes.contains(viewSize) {
+		bad("viewSize %d is not one of sizes", viewSize)
+	}
+	for i, size := range squareSizes {
+		if size <= 0 {
+			bad("squareSizes must be positive")
+			break
+		}
+		if i > 0 && size <= squareSizes[i-1] {
+			bad("squareSizes must be listed smallest first without repeats")
+			break
+		}
+	}
+	if squareThumbs && !squareSizes.contains(thumbSize) {
+		bad("thumbSize %d is not one of squareSizes", thumbSize)
+	}
+	if squareCrop != cropCenter && squareCrop != cropSmart {
+		bad("squareCrop must be %q or %q", cropCenter, cropSmart)
+	}
+	if !sortModes[defaultSort] {
+		bad("unknown defaultSort %q", defaultSort)
+	}
+	problems = append(problems, resampling.validate()...)
+	for _, format := range formats {
+		if _, found := formatTypes[format]; !found {
+			bad("unknown format %q", format)
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("Invalid settings: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// warnSettings logs valid settings that have no effect.
+func warnSettings() {
+	for _, group := range downloadGroups {
+		if hideGPS.contains(group) {
+			log.Warning("Group %s is in both downloadGroups and hideGPS, only editors download its originals.", group)
+		}
+	}
+}
+
+// Disk sessions buffer last use times in memory and only write them on
+// expire checks, so the check interval is capped to bound what a crash
+// loses. A session may also outlive expireSessionTime by one interval.
+const maxExpireInterval = time.Minute
+
+// expireInterval is checkExpireTime, or if zero a tenth of
+// expireSessionTime between one second and maxExpireInterval.
+func expireInterval() time.Duration {
+	if checkExpireTime > 0 {
+		return checkExpireTime
+	}
+	d := expireSessionTime / 10
+	if d > maxExpireInterval {
+		d = maxExpireInterval
+	}
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
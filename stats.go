@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coverFile names the cover image of an album on its first line, unless
+// the description front matter sets one.
+const coverFile = ".cover"
+
+// albumStats summarize an album for the group page.
+type albumStats struct {
+	// Title is the description title.
+	Title string
+	// Hidden is set if the album folder itself is marked hidden.
+	Hidden bool
+	// Cover is an image name, empty for albums without images.
+	Cover string
+	Count int
+	// Capture or modification times of the first and last images.
+	First, Last time.Time
+}
+
+type cachedStats struct {
+	key   string
+	stats albumStats
+}
+
+var (
+	albumStatsLock sync.Mutex
+	albumStatsList = map[string]cachedStats{}
+)
+
+// getAlbumStats returns the album stats, computed again only when the
+// album folder or its settings files change. Album cards are built from
+// them without reading each album description again.
+func getAlbumStats(group, album string) (albumStats, error) {
+	albumPath, err := resolveAlbum(group, album)
+	if err != nil {
+		return albumStats{}, err
+	}
+	key, err := statsKey(albumPath)
+	if err != nil {
+		return albumStats{}, err
+	}
+	albumStatsLock.Lock()
+	cached, found := albumStatsList[albumPath]
+	albumStatsLock.Unlock()
+	if found && cached.key == key {
+		return cached.stats, nil
+	}
+
+	stats, err := readAlbumStats(albumPath)
+	if err != nil {
+		return stats, err
+	}
+	albumStatsLock.Lock()
+	albumStatsList[albumPath] = cachedStats{key: key, stats: stats}
+	albumStatsLock.Unlock()
+	return stats, nil
+}
+
+// invalidateAlbumStats drops the cached stats of an album after an image
+// in it changed in place.
+func invalidateAlbumStats(albumPath string) {
+	albumStatsLock.Lock()
+	delete(albumStatsList, albumPath)
+	albumStatsLock.Unlock()
+}
+
+// statsKey changes when images are added, removed or renamed, when the
+// files choosing the cover or order change, or when the info index giving
+// capture dates is updated.
+func statsKey(albumPath string) (string, error) {
+	fi, err := os.Stat(albumPath)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d", fi.ModTime().UnixNano())
+	for _, name := range []string{descriptionFile, coverFile, sortFile, orderFile, filepath.Join(cacheDir, photoInfoFile)} {
+		if fi, err := os.Stat(filepath.Join(albumPath, name)); err == nil {
+			fmt.Fprintf(&buf, "\x00%s\x00%d", name, fi.ModTime().UnixNano())
+		}
+	}
+	return buf.String(), nil
+}
+
+func readAlbumStats(albumPath string) (albumStats, error) {
+	var stats albumStats
+	desc, images, err := getImages(albumPath)
+	if err != nil {
+		return stats, err
+	}
+	d := parseDescription(desc)
+	stats.Title = d.Title
+	if d.Hidden {
+		stats.Hidden = true
+	} else if _, err := os.Stat(filepath.Join(albumPath, hiddenFile)); err == nil {
+		stats.Hidden = true
+	}
+	stats.Count = len(images)
+	if len(images) == 0 {
+		return stats, nil
+	}
+
+	listed := make(map[string]bool, len(images))
+	for _, image := range images {
+		listed[image] = true
+	}
+	stats.Cover = d.Cover
+	if len(stats.Cover) == 0 {
+		bb, _ := ioutil.ReadFile(filepath.Join(albumPath, coverFile))
+		stats.Cover = strings.TrimSpace(strings.SplitN(string(bb), "\n", 2)[0])
+	}
+	if !listed[stats.Cover] {
+		stats.Cover = images[0]
+	}
+
+	info := albumPhotoInfo(albumPath, images)
+	for _, image := range images {
+		t := info[image].Taken
+		if t.IsZero() {
+			fi, err := os.Stat(filepath.Join(albumPath, image))
+			if err != nil {
+				continue
+			}
+			t = fi.ModTime()
+		}
+		if stats.First.IsZero() || t.Before(stats.First) {
+			stats.First = t
+		}
+		if t.After(stats.Last) {
+			stats.Last = t
+		}
+	}
+	return stats, nil
+}
+
+// DateRange formats the dates of the first and last images as briefly as
+// possible: "Jun 1, 2014", "Jun 1 - Jun 5, 2014" or with both years.
+func (s albumStats) DateRange() string {
+	if s.First.IsZero() {
+		return ""
+	}
+	first, last := s.First, s.Last
+	switch {
+	case first.Format("20060102") == last.Format("20060102"):
+		return first.Format("Jan 2, 2006")
+	case first.Year() == last.Year():
+		return first.Format("Jan 2") + " - " + last.Format("Jan 2, 2006")
+	}
+	return first.Format("Jan 2, 2006") + " - " + last.Format("Jan 2, 2006")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Sniffed content types accepted for upload and the extension used when the
+// uploaded name does not match.
+var uploadTypes = map[string]string{
+	"image/jpeg":            ".jpg",
+	"image/png":             ".png",
+	"image/gif":             ".gif",
+	"image/bmp":             ".bmp",
+	"image/tiff":            ".tif",
+	"image/heif":            ".heic",
+	"image/x-canon-cr3":     ".cr3",
+	"image/x-olympus-orf":   ".orf",
+	"image/x-panasonic-rw2": ".rw2",
+	"image/x-fuji-raf":      ".raf",
+	"video/mp4":             ".mp4",
+	"video/quicktime":       ".mov",
+	"video/webm":            ".webm",
+}
+
+var (
+	errNotImage     = errors.New("Not an image")
+	errUploadTooBig = errors.New("Upload too large")
+)
+
+func checkRole(role string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+		c := w.(*Context)
+		if !c.HasRole(vars["group"], role) {
+			notFoundAuth(w, r)
+			return
+		}
+		if r.Method == "POST" && !sameOrigin(r) {
+			http.Error(w, "Bad request origin", 403)
+			return
+		}
+		h(w, r, vars)
+	}
+}
+
+// /api/upload/:group/*album
+func uploadHandler(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	var (
+		c     = w.(*Context)
+		group = vars["group"]
+		album = strings.Trim(vars["album"], "/")
+	)
+	albumPath, err := resolveAlbum(group, album)
+	if err != nil {
+		notFoundAuth(w, r)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var saved []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if len(part.FileName()) == 0 {
+			continue
+		}
+		name, err := saveUpload(albumPath, part.FileName(), part)
+		part.Close()
+		if err != nil {
+			log.Error("Failed to save upload %q to %s/%s: %v", part.FileName(), group, album, err)
+			go warmCache(group, album, saved)
+			http.Error(w, fmt.Sprintf("%s: %v", part.FileName(), err), 400)
+			return
+		}
+		log.Info("User %s uploaded %s/%s/%s.", c.Username, group, album, name)
+		saved = append(saved, name)
+	}
+	go warmCache(group, album, saved)
+	http.Error(w, strings.Join(saved, "\n"), 200)
+}
+
+// saveUpload writes an uploaded image into the album without replacing an
+// existing file and returns the name used.
+func saveUpload(albumPath, filename string, r io.Reader) (string, error) {
+	name := filepath.Base(strings.Replace(filename, `\`, "/", -1))
+	if !validName(name) {
+		return "", fmt.Errorf("Bad file name %q", filename)
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+	contentType := sniffSource(head)
+	if len(contentType) == 0 {
+		contentType = http.DetectContentType(head)
+	}
+	ext, isImage := uploadTypes[contentType]
+	if !isImage {
+		return "", errNotImage
+	}
+	if uploadTypes[mimeTypeByExt(name)] != ext {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ext
+	}
+
+	// The leading dot hides the partial file from getImages.
+	f, err := ioutil.TempFile(albumPath, ".upload")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(head)
+	if err == nil {
+		var written int64
+		written, err = io.Copy(f, io.LimitReader(r, maxUploadSize-int64(len(head))+1))
+		if err == nil && written+int64(len(head)) > maxUploadSize {
+			err = errUploadTooBig
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Link fails if the name is taken, so files are never replaced.
+	nameExt := filepath.Ext(name)
+	base := strings.TrimSuffix(name, nameExt)
+	for i := 1; ; i++ {
+		err = os.Link(f.Name(), filepath.Join(albumPath, name))
+		if err == nil {
+			return name, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		name = base + " (" + strconv.Itoa(i) + ")" + nameExt
+	}
+}
+
+// sniffSource recognizes originals http.DetectContentType does not: HEIF,
+// CR3 and QuickTime by the major brand of their ftyp box, TIFF and the TIFF
+// based RAW formats by their byte order mark, and a few other RAW headers.
+func sniffSource(head []byte) string {
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		switch string(head[8:12]) {
+		case "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1":
+			return "image/heif"
+		case "crx ":
+			return "image/x-canon-cr3"
+		case "qt  ":
+			return "video/quicktime"
+		}
+		return ""
+	}
+	for _, magic := range []struct {
+		prefix      string
+		contentType string
+	}{
+		{"II*\x00", "image/tiff"},
+		{"MM\x00*", "image/tiff"},
+		{"IIRO", "image/x-olympus-orf"},
+		{"IIRS", "image/x-olympus-orf"},
+		{"MMOR", "image/x-olympus-orf"},
+		{"IIU\x00", "image/x-panasonic-rw2"},
+		{"FUJIFILMCCD-RAW", "image/x-fuji-raf"},
+	} {
+		if bytes.HasPrefix(head, []byte(magic.prefix)) {
+			return magic.contentType
+		}
+	}
+	return ""
+}
+
+// mimeTypeByExt returns the upload type of a file name. TIFF based RAW
+// files share the TIFF type so they keep their own extension.
+func mimeTypeByExt(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".bmp":
+		return "image/bmp"
+	case ".tif", ".tiff", ".cr2", ".nef", ".nrw", ".arw", ".srf", ".sr2", ".pef", ".dng":
+		return "image/tiff"
+	case ".heic", ".heif":
+		return "image/heif"
+	case ".cr3":
+		return "image/x-canon-cr3"
+	case ".orf":
+		return "image/x-olympus-orf"
+	case ".rw2":
+		return "image/x-panasonic-rw2"
+	case ".raf":
+		return "image/x-fuji-raf"
+	case ".mp4", ".m4v":
+		return "video/mp4"
+	case ".mov":
+		return "video/quicktime"
+	case ".webm":
+		return "video/webm"
+	}
+	return ""
+}
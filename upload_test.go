@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSaveUpload(t *testing.T) {
+	albumPath, err := ioutil.TempDir("", "photosite-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(albumPath)
+
+	const (
+		jpegHead = "\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"
+		pngHead  = "\x89PNG\r\n\x1a\n"
+		heicHead = "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"
+		movHead  = "\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00qt  "
+		cr3Head  = "\x00\x00\x00\x18ftypcrx \x00\x00\x00\x01crx isom"
+		tiffHead = "II*\x00\x08\x00\x00\x00"
+		orfHead  = "IIRO\x08\x00\x00\x00"
+		rafHead  = "FUJIFILMCCD-RAW 0201"
+	)
+	list := []struct {
+		filename string
+		data     string
+		name     string
+		ok       bool
+	}{
+		{"a.jpg", jpegHead, "a.jpg", true},
+		{"a.jpg", jpegHead, "a (1).jpg", true},
+		{"b.png", jpegHead, "b.jpg", true},
+		{`C:\photos\c.png`, pngHead, "c.png", true},
+		{"d.heic", heicHead, "d.heic", true},
+		{"d.HEIF", heicHead, "d.HEIF", true},
+		{"e.jpg", heicHead, "e.heic", true},
+		{"f.mov", movHead, "f.mov", true},
+		{"g.cr3", cr3Head, "g.cr3", true},
+		{"h.cr2", tiffHead, "h.cr2", true},
+		{"h.dng", tiffHead, "h.dng", true},
+		{"h.tif", tiffHead, "h.tif", true},
+		{"i.jpg", tiffHead, "i.tif", true},
+		{"j.orf", orfHead, "j.orf", true},
+		{"k.raf", rafHead, "k.raf", true},
+		{"l.heic", "not an image", "", false},
+		{"l.cr2", "not an image", "", false},
+		{"l.mov", "\x00\x00\x00\x18ftypavif", "", false},
+		{"l.txt", "hello", "", false},
+		{".hidden.jpg", jpegHead, "", false},
+		{"..", jpegHead, "", false},
+	}
+	for _, item := range list {
+		name, err := saveUpload(albumPath, item.filename, strings.NewReader(item.data))
+		if (err == nil) != item.ok {
+			t.Errorf("saveUpload(%q) error = %v, want ok %t", item.filename, err, item.ok)
+			continue
+		}
+		if name != item.name {
+			t.Errorf("saveUpload(%q) = %q, want %q", item.filename, name, item.name)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const userCommandUsage = `Usage: %s [flags] user <command>
+	list
+	add <username> <groupA,groupB>
+	remove <username>
+	passwd <username>
+	groups <username> <groupA,groupB>
+`
+
+// runUserCommand edits the users file from the command line. It runs
+// instead of the service verbs when the first argument is "user".
+func runUserCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(userCommandUsage, os.Args[0])
+	}
+	err := loadSettings()
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(root, usersFileName)
+	userList, err := readUsers(filename)
+	if err != nil {
+		return err
+	}
+
+	argCount := map[string]int{
+		"list":   0,
+		"add":    2,
+		"remove": 1,
+		"passwd": 1,
+		"groups": 2,
+	}
+	verb, args := args[0], args[1:]
+	if n, found := argCount[verb]; !found || n != len(args) {
+		return fmt.Errorf(userCommandUsage, os.Args[0])
+	}
+
+	switch verb {
+	case "list":
+		for _, u := range userList.Order {
+			disabled := ""
+			if u.Disabled {
+				disabled = "\tdisabled"
+			}
+			fmt.Printf("%s\t%s%s\n", u.Username, formatGroups(u.Groups, u.Roles), disabled)
+		}
+		return nil
+	case "add":
+		username := args[0]
+		if _, found := userList.ByUsername[username]; found {
+			return fmt.Errorf("User %q already exists", username)
+		}
+		err = validUsername(username)
+		if err != nil {
+			return err
+		}
+		groups, roles, err := parseGroups(args[1])
+		if err != nil {
+			return err
+		}
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		u := &User{
+			Username: username,
+			Password: password,
+			Groups:   groups,
+			Roles:    roles,
+		}
+		userList.Order = append(userList.Order, u)
+		userList.ByUsername[username] = u
+	case "remove":
+		u, err := findUser(userList, args[0])
+		if err != nil {
+			return err
+		}
+		order := userList.Order[:0]
+		for _, item := range userList.Order {
+			if item != u {
+				order = append(order, item)
+			}
+		}
+		userList.Order = order
+		delete(userList.ByUsername, u.Username)
+	case "passwd":
+		u, err := findUser(userList, args[0])
+		if err != nil {
+			return err
+		}
+		u.Password, err = readNewPassword()
+		if err != nil {
+			return err
+		}
+	case "groups":
+		u, err := findUser(userList, args[0])
+		if err != nil {
+			return err
+		}
+		u.Groups, u.Roles, err = parseGroups(args[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = userList.hashPasswords()
+	if err != nil {
+		return err
+	}
+	return saveUsers(filename, userList)
+}
+
+// readUsers loads the users file, failing on any malformed line.
+func readUsers(filename string) (*UserList, error) {
+	userList := &UserList{}
+	bb, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			decodeUsers(nil, userList)
+			return userList, nil
+		}
+		return nil, err
+	}
+	errs := decodeUsers(bb, userList)
+	if len(errs) != 0 {
+		msg := make([]string, len(errs))
+		for i, err := range errs {
+			msg[i] = fmt.Sprintf("%s %v", filename, err)
+		}
+		return nil, fmt.Errorf("%s", strings.Join(msg, "\n"))
+	}
+	return userList, nil
+}
+
+func findUser(userList *UserList, username string) (*User, error) {
+	u, found := userList.ByUsername[username]
+	if !found {
+		return nil, fmt.Errorf("User %q not found", username)
+	}
+	return u, nil
+}
+
+// readNewPassword reads a password from the terminal without echo, or a
+// single line from standard input when it is not a terminal.
+func readNewPassword() (string, error) {
+	var password string
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprint(os.Stderr, "Repeat password: ")
+		repeat, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(b) != string(repeat) {
+			return "", fmt.Errorf("Passwords do not match")
+		}
+		password = string(b)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	err := validPassword(password)
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
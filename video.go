@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// videoRes is the URL size that streams the video itself.
+const videoRes = "video"
+
+// Longest time ffmpeg may take to extract a poster frame.
+const posterTimeout = time.Minute
+
+// Video types listed in albums, by lower case file extension.
+var videoTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+}
+
+var errNoFFmpeg = errors.New("ffmpeg not found, videos have no poster frames")
+
+// ffmpeg is the program found at start by findFFmpeg, "" if there is none.
+var ffmpeg string
+
+func init() {
+	exts := make([]string, 0, len(videoTypes))
+	for ext := range videoTypes {
+		exts = append(exts, ext)
+	}
+	// Poster frames are cached like the sizes of any other image.
+	registerDecoder(decodePoster, ".jpg", exts...)
+}
+
+func isVideoName(name string) bool {
+	_, found := videoTypes[strings.ToLower(filepath.Ext(name))]
+	return found
+}
+
+// findFFmpeg looks up ffmpeg once at start, and logs if poster frames can
+// not be made.
+func findFFmpeg() {
+	path, err := exec.LookPath(ffmpegPath)
+	if err != nil {
+		log.Warning("%v: %v", errNoFFmpeg, err)
+		return
+	}
+	ffmpeg = path
+}
+
+// posterPathOf returns the cached frame the sizes of a video are made from,
+// so ffmpeg runs once per video rather than once per size. Like the sizes
+// it is named after the byte size of the video.
+func posterPathOf(filename string, srcSize int64) string {
+	return filepath.Join(filepath.Dir(filename), cacheDir, filepath.Base(filename)+"@poster-"+strconv.FormatInt(srcSize, 10)+".png")
+}
+
+// decodePoster decodes the poster frame of a video, extracting it first if
+// it is not cached or the video changed.
+func decodePoster(filename string) (image.Image, error) {
+	src, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	posterPath := posterPathOf(filename, src.Size())
+	_, err, _ = cacheFlight.Do(posterPath, func() (interface{}, error) {
+		if cacheValid(src, posterPath) {
+			return nil, nil
+		}
+		frame, err := extractPoster(filename)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(filepath.Dir(posterPath), 0777)
+		if err != nil {
+			return nil, err
+		}
+		return nil, writeAtomic(posterPath, 0644, func(f *os.File) error {
+			_, err := f.Write(frame)
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(f.Name(), src.ModTime(), src.ModTime())
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeWith(png.Decode)(posterPath)
+}
+
+// extractPoster returns a PNG frame one second into the video, or the first
+// frame of shorter videos. ffmpeg rotates the frame by the video metadata.
+func extractPoster(filename string) ([]byte, error) {
+	if len(ffmpeg) == 0 {
+		return nil, errNoFFmpeg
+	}
+	frame, err := ffmpegFrame(ffmpeg, filename, "1")
+	if err != nil {
+		frame, err = ffmpegFrame(ffmpeg, filename, "0")
+	}
+	return frame, err
+}
+
+func ffmpegFrame(path, filename, at string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), posterTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path,
+		"-nostdin", "-v", "error",
+		"-ss", at, "-i", filename,
+		"-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "-",
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("ffmpeg: no frame at " + at + "s")
+	}
+	return stdout.Bytes(), nil
+}
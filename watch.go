@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// Wait for writes to an image to settle before resizing it.
+const watchSettleTime = 2 * time.Second
+
+// startWatcher watches the groups folder, every group and every album and
+// sub-album so changed images are re-cached and removed images lose their
+// cache files.
+func startWatcher() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	groupsPath := filepath.Join(root, groupsFolder)
+	err = w.Add(groupsPath)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	groups, err := readDirNames(groupsPath)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	for _, group := range groups {
+		watchTree(w, filepath.Join(groupsPath, group))
+	}
+	go watchLoop(w, groupsPath)
+	return nil
+}
+
+// watchTree watches a group or album folder and every album below it.
+func watchTree(w *fsnotify.Watcher, dir string) {
+	err := w.Add(dir)
+	if err != nil {
+		log.Warning("Failed to watch %s: %v", dir, err)
+		return
+	}
+	albums, err := readDirNames(dir)
+	if err != nil {
+		return
+	}
+	for _, album := range albums {
+		watchTree(w, filepath.Join(dir, album))
+	}
+}
+
+// settleTimer waits for writes to an image to stop.
+type settleTimer struct {
+	name string
+	t    *time.Timer
+}
+
+func watchLoop(w *fsnotify.Watcher, groupsPath string) {
+	pending := make(map[string]*settleTimer)
+	settled := make(chan *settleTimer)
+
+	for {
+		select {
+		case err := <-w.Errors:
+			log.Warning("Groups watcher: %v", err)
+		case st := <-settled:
+			// A timer that fired after it was replaced or the image was
+			// removed is stale.
+			if pending[st.name] != st {
+				continue
+			}
+			delete(pending, st.name)
+			if _, err := os.Stat(st.name); err != nil {
+				continue
+			}
+			job := cacheJob{albumPath: filepath.Dir(st.name), image: filepath.Base(st.name)}
+			go func() { cacheQueue <- job }()
+		case ev := <-w.Events:
+			rel, err := filepath.Rel(groupsPath, ev.Name)
+			if err != nil {
+				continue
+			}
+			parts := strings.Split(rel, string(filepath.Separator))
+			base := parts[len(parts)-1]
+			if len(base) == 0 || base[0] == '.' {
+				continue
+			}
+			if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && !isImageName(base) {
+				// A removed folder can not be told apart from a file, so
+				// forget any album at or below the path.
+				forgetAlbum(ev.Name)
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				// New group, album or sub-album folder.
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					watchTree(w, ev.Name)
+					continue
+				}
+			}
+			// Files directly in the groups folder or a group are not
+			// album images.
+			if len(parts) >= 3 && isImageName(base) {
+				invalidateAlbumStats(filepath.Dir(ev.Name))
+				if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					if st, found := pending[ev.Name]; found {
+						st.t.Stop()
+						delete(pending, ev.Name)
+					}
+					removeCached(filepath.Dir(ev.Name), base)
+					forgetAlbum(filepath.Dir(ev.Name))
+					continue
+				}
+				if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+					continue
+				}
+				// Only a timer that has not fired yet can be reset, one
+				// that already fired is replaced.
+				if st, found := pending[ev.Name]; found && st.t.Stop() {
+					st.t.Reset(watchSettleTime)
+					continue
+				}
+				st := &settleTimer{name: ev.Name}
+				st.t = time.AfterFunc(watchSettleTime, func() { settled <- st })
+				pending[st.name] = st
+			}
+		}
+	}
+}